@@ -16,14 +16,17 @@ import (
 	"github.com/pkg/errors"
 	"github.com/robertkrimen/otto"
 
+	"github.com/picostack/pico/notify"
 	"github.com/picostack/pico/task"
 )
 
 // State represents a desired system state
 type State struct {
-	Targets     task.Targets      `json:"targets"`
-	AuthMethods []AuthMethod      `json:"auths"`
-	Env         map[string]string `json:"env"`
+	Targets       task.Targets      `json:"targets"`
+	AuthMethods   []AuthMethod      `json:"auths"`
+	Env           map[string]string `json:"env"`
+	Shell         string            `json:"shell"`
+	Notifications []notify.Rule     `json:"notifications"`
 }
 
 // AuthMethod represents a method of authentication for a target
@@ -82,13 +85,35 @@ func (cb *configBuilder) construct(hostname string) (err error) {
 var STATE = {
 	targets: [],
 	auths: [],
-	env: {}
+	env: {},
+	notifications: []
 };
 
 function T(t) {
 	if(t.name === undefined) { throw "target name undefined"; }
 	if(t.url === undefined) { throw "target url undefined"; }
-	if(t.up === undefined) { throw "target up undefined"; }
+	if(t.up === undefined && t.run === undefined && t.steps === undefined) { throw "target up, run or steps undefined"; }
+	if(t.ref !== undefined && (t.tag !== undefined || t.semver !== undefined)) { throw "target ref cannot be combined with tag or semver"; }
+	if(t.down !== undefined && !Array.isArray(t.down)) { throw "target down must be a list of arguments, use down_run for a shell string"; }
+	if(t.down !== undefined && t.down_run !== undefined) { throw "target down cannot be combined with down_run"; }
+	if(t.steps !== undefined) {
+		t.steps.forEach(function(s) {
+			if(s.name === undefined) { throw "step name undefined"; }
+			if(s.command === undefined && s.run === undefined) { throw "step command or run undefined"; }
+		});
+	}
+	if(t.healthcheck !== undefined) {
+		var h = t.healthcheck;
+		if(h.url === undefined && h.tcp === undefined && h.command === undefined && h.run === undefined) {
+			throw "healthcheck url, tcp, command or run undefined";
+		}
+	}
+	if(t.on_change !== undefined && ["up", "restart", "source"].indexOf(t.on_change) === -1) {
+		throw "target on_change must be one of up, restart or source";
+	}
+	if(t.commit_status !== undefined && ["github", "gitlab", "gitea"].indexOf(t.commit_status) === -1) {
+		throw "target commit_status must be one of github, gitlab or gitea";
+	}
 	// if(t.down === undefined) { }
 	// if(t.env) { }
 	// if(t.initial_run) { }
@@ -101,6 +126,10 @@ function E(k, v) {
 	STATE.env[k] = v
 }
 
+function S(shell) {
+	STATE.shell = shell
+}
+
 function A(a) {
 	if(a.name === undefined) { throw "auth name undefined"; }
 	if(a.path === undefined) { throw "auth path undefined"; }
@@ -111,6 +140,24 @@ function A(a) {
 
 	return a.name;
 }
+
+function N(n) {
+	if(n.type === undefined) { throw "notification type undefined"; }
+	if(["webhook", "slack", "discord", "teams", "email"].indexOf(n.type) === -1) {
+		throw "notification type must be one of webhook, slack, discord, teams or email";
+	}
+	if(n.type === "email" && n.to === undefined) { throw "notification to undefined"; }
+	if(n.type !== "email" && n.url === undefined) { throw "notification url undefined"; }
+	if(n.events !== undefined) {
+		n.events.forEach(function(e) {
+			if(["failure", "recovery", "config_fallback"].indexOf(e) === -1) {
+				throw "notification events must be failure, recovery or config_fallback";
+			}
+		});
+	}
+
+	STATE.notifications.push(n);
+}
 `)
 
 	cb.vm.Set("HOSTNAME", hostname) //nolint:errcheck
@@ -138,6 +185,9 @@ function A(a) {
 		return errors.Wrap(err, "failed to get string representation of STATE")
 	}
 	err = json.Unmarshal([]byte(stateRaw), cb.state)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse STATE")
+	}
 
 	for i := range cb.state.Targets {
 		tmpEnv := cb.state.Targets[i].Env
@@ -145,8 +195,14 @@ function A(a) {
 		for k, v := range tmpEnv {
 			cb.state.Targets[i].Env[k] = v
 		}
+		if cb.state.Targets[i].Shell == "" {
+			cb.state.Targets[i].Shell = cb.state.Shell
+		}
 	}
 
+	// targets are started in this order and stopped in reverse, so they're
+	// sorted to make sure dependencies are started first.
+	cb.state.Targets, err = task.SortTargets(cb.state.Targets)
 	return
 }
 
@@ -3,10 +3,12 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/robertkrimen/otto"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/picostack/pico/notify"
 	"github.com/picostack/pico/task"
 )
 
@@ -85,6 +87,60 @@ func Test_applyFileTargets(t *testing.T) {
 		`, task.Targets{
 			{Name: "name", RepoURL: "../test.local", Up: []string{"sleep"}, Env: map[string]string{"GLOBAL": "readme", "LOCAL": "hi"}},
 		}, false},
+		{"steps", `T({
+			name:  "name",
+			url:   "../test.local",
+			steps: [
+				{name: "build", command: ["make"], timeout: "5m"},
+				{name: "up", command: ["docker-compose", "up", "-d"], dir: "deploy", continue_on_error: true}
+			]
+		})`, task.Targets{
+			{
+				Name:    "name",
+				RepoURL: "../test.local",
+				Steps: []task.Step{
+					{Name: "build", Command: []string{"make"}, Timeout: task.Duration(5 * time.Minute)},
+					{Name: "up", Command: []string{"docker-compose", "up", "-d"}, Dir: "deploy", ContinueOnError: true},
+				},
+				Env: map[string]string{},
+			},
+		}, false},
+		{"run", `
+		S("bash");
+		T({name: "1", url: "../test.local", run: "docker-compose pull && docker-compose up -d"});
+		T({name: "2", url: "../test.local", run: "echo $HOSTNAME", shell: "sh"});
+		`, task.Targets{
+			{Name: "1", RepoURL: "../test.local", Run: "docker-compose pull && docker-compose up -d", Shell: "bash", Env: map[string]string{}},
+			{Name: "2", RepoURL: "../test.local", Run: "echo $HOSTNAME", Shell: "sh", Env: map[string]string{}},
+		}, false},
+		{"onchange", `T({name: "name", url: "../test.local", up: ["sleep"], down: ["true"], on_change: "restart"})`, task.Targets{
+			{Name: "name", RepoURL: "../test.local", Up: []string{"sleep"}, Down: []string{"true"}, Env: map[string]string{}, OnChange: task.OnChangeRestart},
+		}, false},
+		{"downrun", `
+		S("bash");
+		T({name: "name", url: "../test.local", run: "docker-compose up -d", down_run: "docker-compose down"});
+		`, task.Targets{
+			{Name: "name", RepoURL: "../test.local", Run: "docker-compose up -d", DownRun: "docker-compose down", Shell: "bash", Env: map[string]string{}},
+		}, false},
+		{"downstring", `T({name: "name", url: "../test.local", up: ["sleep"], down: "docker-compose down"})`, task.Targets{}, true},
+		{"downcombined", `T({name: "name", url: "../test.local", up: ["sleep"], down: ["true"], down_run: "true"})`, task.Targets{}, true},
+		{"badonchange", `T({name: "name", url: "../test.local", up: ["sleep"], on_change: "sometimes"})`, task.Targets{}, true},
+		{"dependencies", `
+		T({name: "app", url: "../test.local", up: ["sleep"], depends_on: ["db"]});
+		T({name: "db", url: "../test.local", up: ["sleep"]});
+		`, task.Targets{
+			{Name: "db", RepoURL: "../test.local", Up: []string{"sleep"}, Env: map[string]string{}},
+			{Name: "app", RepoURL: "../test.local", Up: []string{"sleep"}, Env: map[string]string{}, DependsOn: []string{"db"}},
+		}, false},
+		{"dependencycycle", `
+		T({name: "a", url: "../test.local", up: ["sleep"], depends_on: ["b"]});
+		T({name: "b", url: "../test.local", up: ["sleep"], depends_on: ["a"]});
+		`, task.Targets{}, true},
+		{"commitstatus", `T({name: "name", url: "../test.local", up: ["sleep"], commit_status: "gitea"})`, task.Targets{
+			{Name: "name", RepoURL: "../test.local", Up: []string{"sleep"}, Env: map[string]string{}, CommitStatus: "gitea"},
+		}, false},
+		{"badcommitstatus", `T({name: "name", url: "../test.local", up: ["sleep"], commit_status: "svn"})`, task.Targets{}, true},
+		{"missingstepcommand", `T({name: "name", url: "../test.local", steps: [{name: "build"}]})`, task.Targets{}, true},
 		{"badtype", `T({name: "name", url: "../test.local", up: 1.23})`, task.Targets{}, true},
 		{"missingkey", `T({name: "name", url: "../test.local"})`, task.Targets{}, true},
 		{"env", `console.log(ENV["TEST_ENV_KEY"])`, task.Targets{}, false},
@@ -112,3 +168,43 @@ func Test_applyFileTargets(t *testing.T) {
 		})
 	}
 }
+
+func TestNotifications(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    []notify.Rule
+		wantErr bool
+	}{
+		{"slack", `N({name: "ops", type: "slack", url: "https://hooks.slack.test/1", targets: ["app"], events: ["failure"]})`, []notify.Rule{
+			{Name: "ops", Type: "slack", URL: "https://hooks.slack.test/1", Targets: []string{"app"}, Events: []string{"failure"}},
+		}, false},
+		{"email", `N({name: "oncall", type: "email", to: ["ops@pico.test"]})`, []notify.Rule{
+			{Name: "oncall", Type: "email", To: []string{"ops@pico.test"}},
+		}, false},
+		{"none", ``, []notify.Rule{}, false},
+		{"badtype", `N({type: "pager", url: "https://pager.test"})`, nil, true},
+		{"missingurl", `N({type: "webhook"})`, nil, true},
+		{"missingto", `N({type: "email"})`, nil, true},
+		{"badevent", `N({type: "webhook", url: "https://hook.test", events: ["sometimes"]})`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := configBuilder{
+				vm:      otto.New(),
+				state:   new(State),
+				scripts: []string{tt.script},
+			}
+
+			err := cb.construct("host")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, cb.state.Notifications)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Package events provides an internal bus for the significant things that
+// happen in the daemon: the config being fetched and evaluated, states being
+// applied and tasks being queued and executed. The watcher, reconfigurer and
+// executor publish to it and sinks write the events out as an audit trail of
+// what was deployed, when, and on which host.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/picostack/pico/logger"
+	"github.com/picostack/pico/task"
+)
+
+// Types of event
+const (
+	ConfigFetched   = "config_fetched"
+	ConfigEvaluated = "config_evaluated"
+	StateDiffed     = "state_diffed"
+	TaskQueued      = "task_queued"
+	TaskStarted     = "task_started"
+	TaskFinished    = "task_finished"
+	SecretFailed    = "secret_fetch_failed"
+)
+
+// sinkBuffer is how many events can wait for a slow sink before they're dropped
+const sinkBuffer = 1024
+
+// Event is a single entry in the event stream, only the fields relevant to its
+// type are set.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Hostname string    `json:"hostname"`
+	Repo     string    `json:"repo,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Trigger  string    `json:"trigger,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	Changed  []string  `json:"changed,omitempty"`
+}
+
+// ForTask creates an event describing the task
+func ForTask(kind string, t task.ExecutionTask) Event {
+	action := "up"
+	if t.Shutdown {
+		action = "down"
+	}
+	return Event{
+		Type:    kind,
+		Target:  t.Target.Name,
+		Action:  action,
+		Trigger: t.Env["PICO_TRIGGER"],
+		Commit:  t.Env["PICO_COMMIT_SHA"],
+		Author:  t.Env["PICO_COMMIT_AUTHOR"],
+	}
+}
+
+// Sink writes events somewhere
+type Sink interface {
+	Write(Event) error
+}
+
+// Bus delivers published events to every sink. Each sink has its own buffer and
+// goroutine so a slow one doesn't hold up the others, or the publisher.
+type Bus struct {
+	mu       sync.Mutex
+	hostname string
+	sinks    []chan Event
+	wg       sync.WaitGroup
+}
+
+// New creates a bus with no sinks
+func New() *Bus {
+	return &Bus{}
+}
+
+// SetHostname sets the hostname every event is published with
+func (b *Bus) SetHostname(hostname string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hostname = hostname
+}
+
+// Subscribe delivers every event published from now on to the sink
+func (b *Bus) Subscribe(name string, s Sink) {
+	events := make(chan Event, sinkBuffer)
+	b.mu.Lock()
+	b.sinks = append(b.sinks, events)
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for e := range events {
+			if err := s.Write(e); err != nil {
+				zap.L().Warn("failed to write event",
+					zap.String("sink", name),
+					zap.String("type", e.Type),
+					zap.Error(err))
+			}
+		}
+	}()
+}
+
+// Publish sends the event to every sink. It never blocks, if a sink has fallen
+// too far behind the event is dropped for that sink.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Hostname = b.hostname
+	// errors can contain the output of commands, which is where secrets leak
+	e.Error = logger.Redact(e.Error)
+	for _, s := range b.sinks {
+		select {
+		case s <- e:
+		default:
+			zap.L().Warn("event sink is falling behind, dropped event",
+				zap.String("type", e.Type))
+		}
+	}
+}
+
+// Close waits for every sink to write the events that were published and stops
+// them. Events published afterwards are discarded.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	for _, s := range b.sinks {
+		close(s)
+	}
+	b.sinks = nil
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+var std = New()
+
+// SetHostname sets the hostname of the default bus
+func SetHostname(hostname string) { std.SetHostname(hostname) }
+
+// Subscribe adds a sink to the default bus
+func Subscribe(name string, s Sink) { std.Subscribe(name, s) }
+
+// Publish publishes an event on the default bus
+func Publish(e Event) { std.Publish(e) }
+
+// Close flushes and stops the sinks of the default bus
+func Close() { std.Close() }
@@ -0,0 +1,126 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/logger"
+	"github.com/picostack/pico/task"
+)
+
+type memorySink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *memorySink) Write(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestBus(t *testing.T) {
+	b := New()
+	b.SetHostname("host")
+	sink := &memorySink{}
+	b.Subscribe("memory", sink)
+
+	b.Publish(Event{Type: StateDiffed, Added: []string{"app"}})
+	b.Publish(ForTask(TaskStarted, task.ExecutionTask{
+		Target:   task.Target{Name: "app"},
+		Shutdown: true,
+		Env: map[string]string{
+			"PICO_TRIGGER":       task.TriggerRemove,
+			"PICO_COMMIT_SHA":    "abc123",
+			"PICO_COMMIT_AUTHOR": "Southclaws",
+		},
+	}))
+	b.Close()
+
+	// events published after closing are discarded
+	b.Publish(Event{Type: TaskFinished})
+
+	require.Len(t, sink.events, 2)
+	assert.Equal(t, StateDiffed, sink.events[0].Type)
+	assert.Equal(t, "host", sink.events[0].Hostname)
+	assert.False(t, sink.events[0].Time.IsZero())
+	assert.Equal(t, Event{
+		Time:     sink.events[1].Time,
+		Type:     TaskStarted,
+		Hostname: "host",
+		Target:   "app",
+		Action:   "down",
+		Trigger:  task.TriggerRemove,
+		Commit:   "abc123",
+		Author:   "Southclaws",
+	}, sink.events[1])
+}
+
+func TestBusRedactsErrors(t *testing.T) {
+	logger.AddSecrets("events-secret")
+
+	b := New()
+	sink := &memorySink{}
+	b.Subscribe("memory", sink)
+	b.Publish(Event{Type: TaskFinished, Error: "exit status 1: bad token events-secret"})
+	b.Close()
+
+	require.Len(t, sink.events, 1)
+	assert.Equal(t, "exit status 1: bad token "+logger.Redacted, sink.events[0].Error)
+}
+
+func TestSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	posted := []Event{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		mu.Lock()
+		posted = append(posted, e)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	path := filepath.Join(dir, "audit.jsonl")
+	file, err := NewFileSink(path)
+	require.NoError(t, err)
+
+	b := New()
+	b.Subscribe("file", file)
+	b.Subscribe("webhook", NewWebhookSink(server.URL))
+	b.Publish(Event{Type: ConfigFetched, Commit: "one"})
+	b.Publish(Event{Type: ConfigEvaluated, Commit: "one", Result: "success"})
+	b.Close()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	lines := []Event{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		lines = append(lines, e)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, ConfigFetched, lines[0].Type)
+	assert.Equal(t, ConfigEvaluated, lines[1].Type)
+
+	require.Len(t, posted, 2)
+	assert.Equal(t, "success", posted[1].Result)
+}
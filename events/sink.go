@@ -0,0 +1,63 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileSink appends events to a file as JSON lines
+type FileSink struct {
+	f *os.File
+}
+
+// NewFileSink opens the file for appending, creating it if it doesn't exist
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open event log")
+	}
+	return &FileSink{f}, nil
+}
+
+// Write implements Sink
+func (s *FileSink) Write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+	_, err = s.f.Write(append(b, '\n'))
+	return errors.Wrap(err, "failed to write event")
+}
+
+// WebhookSink posts each event as JSON to a URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink creates a sink that posts to the URL
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url, &http.Client{Timeout: time.Second * 10}}
+}
+
+// Write implements Sink
+func (s *WebhookSink) Write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "failed to post event")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
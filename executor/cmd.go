@@ -1,11 +1,24 @@
 package executor
 
 import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"github.com/picostack/pico/events"
+	"github.com/picostack/pico/forge"
+	"github.com/picostack/pico/logger"
+	"github.com/picostack/pico/metrics"
+	"github.com/picostack/pico/notify"
 	"github.com/picostack/pico/secret"
 	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/tracing"
 )
 
 var _ Executor = &CommandExecutor{}
@@ -16,6 +29,30 @@ type CommandExecutor struct {
 	passEnvironment    bool   // pass the Pico process environment to children
 	configSecretPath   string // path to global secrets to pass to children
 	configSecretPrefix string // only pass secrets with this prefix, usually GLOBAL_
+	notifier           *notify.Notifier
+	reporter           *forge.Reporter
+	listener           Listener
+
+	deployed map[string]string // last healthy commit deployed for each target
+	failed   map[string]string // last commit that failed its health check
+
+	unavailable map[string]bool               // targets whose last `up` failed or was skipped
+	blocked     map[string]task.ExecutionTask // tasks waiting on a dependency
+
+	mu       sync.Mutex // guards statuses, outputs and writes to deployed
+	statuses map[string]RunStatus
+	outputs  map[string]*output // recent output of each target's commands
+}
+
+// RunStatus describes the outcome of the last task executed for a target
+type RunStatus struct {
+	Action   string        `json:"action"`
+	Result   string        `json:"result"`
+	Error    string        `json:"error,omitempty"`
+	Commit   string        `json:"commit,omitempty"`
+	Trigger  string        `json:"trigger,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
 }
 
 // NewCommandExecutor creates a new CommandExecutor
@@ -24,23 +61,255 @@ func NewCommandExecutor(
 	passEnvironment bool,
 	configSecretPath string,
 	configSecretPrefix string,
-) CommandExecutor {
-	return CommandExecutor{
+	notifier *notify.Notifier,
+	reporter *forge.Reporter,
+	listener Listener,
+) *CommandExecutor {
+	return &CommandExecutor{
 		secrets:            secrets,
 		passEnvironment:    passEnvironment,
 		configSecretPath:   configSecretPath,
 		configSecretPrefix: configSecretPrefix,
+		notifier:           notifier,
+		reporter:           reporter,
+		listener:           listener,
+		deployed:           make(map[string]string),
+		failed:             make(map[string]string),
+		unavailable:        make(map[string]bool),
+		blocked:            make(map[string]task.ExecutionTask),
+		statuses:           make(map[string]RunStatus),
+		outputs:            make(map[string]*output),
 	}
 }
 
 // Subscribe implements executor.Executor
 func (e *CommandExecutor) Subscribe(bus chan task.ExecutionTask) {
 	for t := range bus {
-		if err := e.execute(t.Target, t.Path, t.Shutdown, t.Env); err != nil {
-			zap.L().Error("executor task unsuccessful",
+		e.Handle(t)
+	}
+}
+
+// Handle executes a single task and logs the outcome. A target is not started
+// while any of its dependencies failed to start or is itself held back, it's
+// held back too and started as soon as they all have.
+func (e *CommandExecutor) Handle(t task.ExecutionTask) {
+	if !t.Shutdown {
+		if dep := e.unavailableDependency(t.Target); dep != "" {
+			zap.L().Warn("skipping target until its dependency starts",
 				zap.String("target", t.Target.Name),
-				zap.Bool("shutdown", t.Shutdown),
-				zap.Error(err))
+				zap.String("dependency", dep))
+			e.blocked[t.Target.Name] = t
+			e.unavailable[t.Target.Name] = true
+			e.setStatus(t, RunStatus{
+				Result:  metrics.ResultSkipped,
+				Error:   "waiting for dependency " + dep,
+				Started: time.Now(),
+			})
+			metrics.Executions.WithLabelValues(t.Target.Name, metrics.Action(false), metrics.ResultSkipped).Inc()
+			skipped := events.ForTask(events.TaskFinished, t)
+			skipped.Result = metrics.ResultSkipped
+			skipped.Error = "waiting for dependency " + dep
+			events.Publish(skipped)
+			return
+		}
+	}
+
+	e.reporter.Pending(t)
+	events.Publish(events.ForTask(events.TaskStarted, t))
+	ctx := tracing.WithTraceparent(context.Background(), t.Env[tracing.EnvVar])
+	_, span := tracing.Start(ctx, "execute")
+	span.SetAttribute("target", t.Target.Name)
+	span.SetAttribute("action", metrics.Action(t.Shutdown))
+	span.SetAttribute("trigger", t.Env["PICO_TRIGGER"])
+	span.SetAttribute("commit", t.Env["PICO_COMMIT_SHA"])
+	start := time.Now()
+	err := e.execute(t.Target, t.Path, t.Shutdown, withTraceparent(t.Env, span))
+	span.SetError(err)
+	span.End()
+	observe(t, start, err)
+	finished(t, start, err)
+	e.notify(t, err)
+	e.reporter.Done(t, err)
+	status := RunStatus{
+		Result:   metrics.ResultSuccess,
+		Started:  start,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		status.Result = metrics.ResultFailure
+		status.Error = logger.Redact(err.Error())
+	}
+	e.setStatus(t, status)
+	if err != nil {
+		zap.L().Error("executor task unsuccessful",
+			zap.String("target", t.Target.Name),
+			zap.Bool("shutdown", t.Shutdown),
+			zap.Error(err))
+	}
+	if e.listener != nil {
+		e.listener.Finished(t, err)
+	}
+	e.record(t, err)
+}
+
+// withTraceparent returns a copy of the environment that passes the span to the
+// commands, so any spans they record are children of it.
+func withTraceparent(env map[string]string, span *tracing.Span) map[string]string {
+	traceparent := span.Traceparent()
+	if traceparent == "" {
+		return env
+	}
+	traced := make(map[string]string, len(env)+1)
+	for k, v := range env {
+		traced[k] = v
+	}
+	traced[tracing.EnvVar] = traceparent
+	return traced
+}
+
+// notify reports the task failing, or succeeding when the last time the same
+// action was run for the target it failed.
+func (e *CommandExecutor) notify(t task.ExecutionTask, err error) {
+	action := metrics.Action(t.Shutdown)
+	event := notify.Event{
+		Target: t.Target.Name,
+		Action: action,
+		Commit: t.Env["PICO_COMMIT_SHA"],
+	}
+	if err != nil {
+		event.Kind = notify.EventFailure
+		event.Error = err.Error()
+		e.notifier.Notify(event)
+		return
+	}
+	e.mu.Lock()
+	previous, ok := e.statuses[t.Target.Name]
+	e.mu.Unlock()
+	if ok && previous.Action == action && previous.Result == metrics.ResultFailure {
+		event.Kind = notify.EventRecovery
+		e.notifier.Notify(event)
+	}
+}
+
+func (e *CommandExecutor) setStatus(t task.ExecutionTask, s RunStatus) {
+	s.Action = metrics.Action(t.Shutdown)
+	s.Commit = t.Env["PICO_COMMIT_SHA"]
+	s.Trigger = t.Env["PICO_TRIGGER"]
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.statuses[t.Target.Name] = s
+}
+
+// Statuses returns the outcome of the last task executed for each target
+func (e *CommandExecutor) Statuses() map[string]RunStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := make(map[string]RunStatus)
+	for k, v := range e.statuses {
+		statuses[k] = v
+	}
+	return statuses
+}
+
+// Deployed returns the last commit of each target that was deployed and passed
+// its health check
+func (e *CommandExecutor) Deployed() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	deployed := make(map[string]string)
+	for k, v := range e.deployed {
+		deployed[k] = v
+	}
+	return deployed
+}
+
+// Output returns the most recent output of the target's commands. The output
+// is also written to stdout as it's produced.
+func (e *CommandExecutor) Output(name string) []byte {
+	e.mu.Lock()
+	o, ok := e.outputs[name]
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return o.Bytes()
+}
+
+func (e *CommandExecutor) output(name string) io.Writer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	o, ok := e.outputs[name]
+	if !ok {
+		o = &output{}
+		e.outputs[name] = o
+	}
+	return io.MultiWriter(os.Stdout, o)
+}
+
+func finished(t task.ExecutionTask, start time.Time, err error) {
+	e := events.ForTask(events.TaskFinished, t)
+	e.Result = metrics.ResultSuccess
+	e.Duration = time.Since(start).Seconds()
+	if err != nil {
+		e.Result = metrics.ResultFailure
+		e.Error = err.Error()
+	}
+	events.Publish(e)
+}
+
+func observe(t task.ExecutionTask, start time.Time, err error) {
+	action := metrics.Action(t.Shutdown)
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultFailure
+	}
+	metrics.Executions.WithLabelValues(t.Target.Name, action, result).Inc()
+	metrics.ExecutionDuration.WithLabelValues(t.Target.Name, action).Observe(time.Since(start).Seconds())
+}
+
+func (e *CommandExecutor) unavailableDependency(target task.Target) string {
+	for _, d := range target.DependsOn {
+		if e.unavailable[d] {
+			return d
+		}
+	}
+	return ""
+}
+
+// record tracks whether the target is available to its dependants and starts
+// any dependants that were waiting for it.
+func (e *CommandExecutor) record(t task.ExecutionTask, err error) {
+	name := t.Target.Name
+	delete(e.blocked, name)
+	if t.Shutdown {
+		delete(e.unavailable, name)
+		return
+	}
+	if err != nil {
+		e.unavailable[name] = true
+		return
+	}
+	if !e.unavailable[name] {
+		return
+	}
+	delete(e.unavailable, name)
+
+	waiting := []string{}
+	for n, b := range e.blocked {
+		for _, d := range b.Target.DependsOn {
+			if d == name {
+				waiting = append(waiting, n)
+				break
+			}
+		}
+	}
+	sort.Strings(waiting)
+	for _, n := range waiting {
+		if b, ok := e.blocked[n]; ok {
+			zap.L().Info("starting target now that its dependency started",
+				zap.String("target", n),
+				zap.String("dependency", name))
+			e.Handle(b)
 		}
 	}
 }
@@ -50,6 +319,7 @@ type exec struct {
 	env             map[string]string
 	shutdown        bool
 	passEnvironment bool
+	out             io.Writer
 }
 
 func (e *CommandExecutor) prepare(
@@ -62,12 +332,16 @@ func (e *CommandExecutor) prepare(
 	// only secrets with the prefix are retrieved.
 	global, err := secret.GetPrefixedSecrets(e.secrets, e.configSecretPath, e.configSecretPrefix)
 	if err != nil {
-		return exec{}, errors.Wrap(err, "failed to get global secrets for target")
+		err = errors.Wrap(err, "failed to get global secrets for target")
+		events.Publish(events.Event{Type: events.SecretFailed, Target: name, Error: err.Error()})
+		return exec{}, err
 	}
 
 	secrets, err := e.secrets.GetSecretsForTarget(name)
 	if err != nil {
-		return exec{}, errors.Wrap(err, "failed to get secrets for target")
+		err = errors.Wrap(err, "failed to get secrets for target")
+		events.Publish(events.Event{Type: events.SecretFailed, Target: name, Error: err.Error()})
+		return exec{}, err
 	}
 
 	env := make(map[string]string)
@@ -84,7 +358,7 @@ func (e *CommandExecutor) prepare(
 		env[k] = v
 	}
 
-	return exec{path, env, shutdown, e.passEnvironment}, nil
+	return exec{path, env, shutdown, e.passEnvironment, nil}, nil
 }
 
 func (e *CommandExecutor) execute(
@@ -97,14 +371,137 @@ func (e *CommandExecutor) execute(
 	if err != nil {
 		return err
 	}
+	out := logger.NewWriter(e.output(target.Name))
+	defer out.Flush() //nolint:errcheck
+	ex.out = out
 
 	zap.L().Debug("executing with secrets",
 		zap.String("target", target.Name),
-		zap.Strings("cmd", target.Up),
+		zap.Any("steps", target.Pipeline(shutdown)),
 		zap.String("url", target.RepoURL),
 		zap.String("dir", path),
 		zap.Any("env", ex.env),
 		zap.Bool("passthrough", e.passEnvironment))
 
-	return target.Execute(ex.path, ex.env, ex.shutdown, ex.passEnvironment)
+	if !shutdown {
+		return e.deploy(target, ex)
+	}
+
+	results, err := target.Execute(ex.path, ex.env, ex.shutdown, ex.passEnvironment, ex.out)
+	logResults(target.Name, results)
+
+	return err
+}
+
+// deploy runs the target's pipeline followed by its health check. If the health
+// check fails, the target's repository is reset to the last commit that was
+// deployed successfully and the pipeline is run again to restore it.
+func (e *CommandExecutor) deploy(target task.Target, ex exec) error {
+	commit, err := headCommit(ex.path)
+	if err != nil {
+		zap.L().Debug("could not determine commit for target",
+			zap.String("target", target.Name),
+			zap.Error(err))
+	}
+
+	if previous, ok := e.healthy(target.Name, ex); ok && commit != "" && e.failed[target.Name] == commit {
+		return e.redeploy(target, ex, commit, previous)
+	}
+
+	results, err := target.Execute(ex.path, ex.env, false, ex.passEnvironment, ex.out)
+	logResults(target.Name, results)
+	if err != nil {
+		return err
+	}
+
+	if err = target.CheckHealth(ex.path, ex.env, ex.passEnvironment, ex.out); err != nil {
+		return e.rollback(target, ex, commit, err)
+	}
+
+	if commit != "" {
+		e.mu.Lock()
+		e.deployed[target.Name] = commit
+		e.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (e *CommandExecutor) rollback(target task.Target, ex exec, commit string, cause error) error {
+	previous, ok := e.healthy(target.Name, ex)
+	if !ok || commit == "" || previous == commit {
+		return errors.Wrap(cause, "no previously deployed commit to roll back to")
+	}
+
+	zap.L().Warn("health check failed, rolling back to previous commit",
+		zap.String("target", target.Name),
+		zap.String("commit", commit),
+		zap.String("previous", previous),
+		zap.Error(cause))
+
+	e.failed[target.Name] = commit
+
+	if err := checkout(ex.path, previous); err != nil {
+		return errors.Wrapf(err, "failed to check out previous commit %s after: %v", previous, cause)
+	}
+
+	results, err := target.Execute(ex.path, ex.env, false, ex.passEnvironment, ex.out)
+	logResults(target.Name, results)
+	if err != nil {
+		return errors.Wrapf(err, "failed to redeploy previous commit %s after: %v", previous, cause)
+	}
+
+	return errors.Wrapf(cause, "rolled back to %s", previous)
+}
+
+// redeploy runs the pipeline at the previous commit in place of one that already
+// failed its health check, so a target that's run again, such as when its config
+// changes or it's restarted, still ends up running.
+func (e *CommandExecutor) redeploy(target task.Target, ex exec, commit, previous string) error {
+	zap.L().Warn("commit previously failed its health check, redeploying previous commit",
+		zap.String("target", target.Name),
+		zap.String("commit", commit),
+		zap.String("previous", previous))
+
+	if err := checkout(ex.path, previous); err != nil {
+		return errors.Wrapf(err, "failed to check out previous commit %s", previous)
+	}
+
+	results, err := target.Execute(ex.path, ex.env, false, ex.passEnvironment, ex.out)
+	logResults(target.Name, results)
+	if err != nil {
+		return errors.Wrapf(err, "failed to redeploy previous commit %s", previous)
+	}
+
+	return &task.RedeployedError{Commit: commit, Previous: previous}
+}
+
+// healthy returns the last commit of the target that was deployed successfully.
+// Once the daemon has restarted, only the watcher knows this, which it passes
+// along as the previous commit.
+func (e *CommandExecutor) healthy(name string, ex exec) (string, bool) {
+	e.mu.Lock()
+	previous, ok := e.deployed[name]
+	e.mu.Unlock()
+	if !ok {
+		previous = ex.env["PICO_PREVIOUS_SHA"]
+	}
+	return previous, previous != ""
+}
+
+func logResults(name string, results []task.StepResult) {
+	for _, r := range results {
+		if r.Err != nil {
+			zap.L().Error("step failed",
+				zap.String("target", name),
+				zap.String("step", r.Name),
+				zap.Duration("duration", r.Duration),
+				zap.Error(r.Err))
+		} else {
+			zap.L().Info("step succeeded",
+				zap.String("target", name),
+				zap.String("step", r.Name),
+				zap.Duration("duration", r.Duration))
+		}
+	}
 }
@@ -1,14 +1,29 @@
 package executor
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"golang.org/x/sync/errgroup"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 
+	"github.com/picostack/pico/metrics"
+	"github.com/picostack/pico/notify"
+	"github.com/picostack/pico/secret"
 	"github.com/picostack/pico/secret/memory"
 	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/tracing"
 	"github.com/stretchr/testify/assert"
 
 	_ "github.com/picostack/pico/logger"
@@ -26,7 +41,7 @@ func TestCommandExecutor(t *testing.T) {
 				"SOME_SECRET": "123",
 			},
 		},
-	}, false, "pico", "GLOBAL_")
+	}, false, "pico", "GLOBAL_", nil, nil, nil)
 	bus := make(chan task.ExecutionTask)
 
 	g := errgroup.Group{}
@@ -65,7 +80,7 @@ func TestCommandPrepareWithoutPassthrough(t *testing.T) {
 				"SOME_SECRET": "123",
 			},
 		},
-	}, false, "pico", "GLOBAL_")
+	}, false, "pico", "GLOBAL_", nil, nil, nil)
 
 	ex, err := ce.prepare("test", "./", false, map[string]string{
 		"DATA_DIR": "/data/shared",
@@ -93,7 +108,7 @@ func TestCommandPrepareWithGlobal(t *testing.T) {
 				"IGNORE":        "this",
 			},
 		},
-	}, false, "pico", "GLOBAL_")
+	}, false, "pico", "GLOBAL_", nil, nil, nil)
 
 	ex, err := ce.prepare("test", "./", false, map[string]string{
 		"DATA_DIR": "/data/shared",
@@ -110,3 +125,194 @@ func TestCommandPrepareWithGlobal(t *testing.T) {
 		passEnvironment: false,
 	}, ex)
 }
+
+func TestCommandExecutorRollback(t *testing.T) {
+	dir := filepath.Join(".test", "rollback")
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	sig := &object.Signature{Name: "test", Email: "test@pico.sh", When: time.Now()}
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "healthy"), nil, 0644))
+	_, err = wt.Add("healthy")
+	assert.NoError(t, err)
+	good, err := wt.Commit("good", &git.CommitOptions{Author: sig})
+	assert.NoError(t, err)
+
+	_, err = wt.Remove("healthy")
+	assert.NoError(t, err)
+	bad, err := wt.Commit("bad", &git.CommitOptions{Author: sig})
+	assert.NoError(t, err)
+
+	ce := NewCommandExecutor(&memory.MemorySecrets{}, false, "pico", "GLOBAL_", nil, nil, nil)
+	target := task.Target{
+		Name: "rollback",
+		Run:  "echo deploying",
+		HealthCheck: &task.HealthCheck{
+			Run:      "test -f healthy",
+			Interval: task.Duration(time.Millisecond),
+		},
+	}
+
+	// deploy the healthy commit first so there's something to roll back to
+	assert.NoError(t, wt.Reset(&git.ResetOptions{Commit: good, Mode: git.HardReset}))
+	assert.NoError(t, ce.execute(target, dir, false, nil))
+
+	// the bad commit fails its health check and is rolled back
+	assert.NoError(t, wt.Reset(&git.ResetOptions{Commit: bad, Mode: git.HardReset}))
+	assert.Error(t, ce.execute(target, dir, false, nil))
+
+	head, err := repo.Head()
+	assert.NoError(t, err)
+	assert.Equal(t, good, head.Hash())
+
+	// the bad commit is not deployed again when the target is run again, the
+	// healthy commit is deployed in its place
+	assert.NoError(t, wt.Reset(&git.ResetOptions{Commit: bad, Mode: git.HardReset}))
+	runs := strings.Count(string(ce.Output("rollback")), "deploying")
+	err = ce.execute(target, dir, false, nil)
+	var redeployed *task.RedeployedError
+	if assert.True(t, errors.As(err, &redeployed)) {
+		assert.Equal(t, bad.String(), redeployed.Commit)
+		assert.Equal(t, good.String(), redeployed.Previous)
+	}
+	assert.Equal(t, runs+1, strings.Count(string(ce.Output("rollback")), "deploying"))
+
+	head, err = repo.Head()
+	assert.NoError(t, err)
+	assert.Equal(t, good, head.Hash())
+
+	// after a restart the last healthy commit comes from the watcher
+	ce = NewCommandExecutor(&memory.MemorySecrets{}, false, "pico", "GLOBAL_", nil, nil, nil)
+	assert.NoError(t, wt.Reset(&git.ResetOptions{Commit: bad, Mode: git.HardReset}))
+	assert.Error(t, ce.execute(target, dir, false, map[string]string{"PICO_PREVIOUS_SHA": good.String()}))
+
+	head, err = repo.Head()
+	assert.NoError(t, err)
+	assert.Equal(t, good, head.Hash())
+}
+
+func TestCommandExecutorDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-deps")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ce := NewCommandExecutor(&memory.MemorySecrets{}, false, "pico", "GLOBAL_", nil, nil, nil)
+
+	db := task.Target{Name: "db", Up: []string{"false"}}
+	app := task.Target{Name: "app", Up: []string{"touch", "started"}, DependsOn: []string{"db"}}
+	started := filepath.Join(dir, "started")
+
+	// the app is skipped while the database fails to start
+	ce.Handle(task.ExecutionTask{Target: db, Path: dir})
+	ce.Handle(task.ExecutionTask{Target: app, Path: dir})
+	_, err = os.Stat(started)
+	assert.True(t, os.IsNotExist(err), "expected app to be skipped")
+
+	// once the database starts, the app is started straight away
+	db.Up = []string{"true"}
+	ce.Handle(task.ExecutionTask{Target: db, Path: dir})
+	_, err = os.Stat(started)
+	assert.NoError(t, err, "expected app to start after its dependency")
+	assert.Empty(t, ce.blocked)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Executions.WithLabelValues("db", "up", metrics.ResultFailure)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Executions.WithLabelValues("db", "up", metrics.ResultSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Executions.WithLabelValues("app", "up", metrics.ResultSkipped)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Executions.WithLabelValues("app", "up", metrics.ResultSuccess)))
+}
+
+func TestCommandExecutorTransitiveDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-deps")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ce := NewCommandExecutor(&memory.MemorySecrets{}, false, "pico", "GLOBAL_", nil, nil, nil)
+
+	db := task.Target{Name: "db", Up: []string{"false"}}
+	api := task.Target{Name: "api", Up: []string{"sh", "-c", "echo api >> order"}, DependsOn: []string{"db"}}
+	web := task.Target{Name: "web", Up: []string{"sh", "-c", "echo web >> order"}, DependsOn: []string{"api"}}
+	order := filepath.Join(dir, "order")
+
+	// the web target is skipped since the api it depends on is held back
+	ce.Handle(task.ExecutionTask{Target: db, Path: dir})
+	ce.Handle(task.ExecutionTask{Target: api, Path: dir})
+	ce.Handle(task.ExecutionTask{Target: web, Path: dir})
+	_, err = os.Stat(order)
+	assert.True(t, os.IsNotExist(err), "expected api and web to be skipped")
+
+	// once the database starts, the rest of the chain starts in order
+	db.Up = []string{"true"}
+	ce.Handle(task.ExecutionTask{Target: db, Path: dir})
+	b, err := ioutil.ReadFile(order)
+	assert.NoError(t, err)
+	assert.Equal(t, "api\nweb\n", string(b))
+	assert.Empty(t, ce.blocked)
+	assert.Empty(t, ce.unavailable)
+}
+
+func TestCommandExecutorNotifications(t *testing.T) {
+	var mu sync.Mutex
+	kinds := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		mu.Lock()
+		kinds = append(kinds, e.Kind)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	n := notify.New("host", notify.SMTP{})
+	n.SetRules([]notify.Rule{{Type: notify.TypeWebhook, URL: server.URL}})
+	ce := NewCommandExecutor(&memory.MemorySecrets{}, false, "pico", "GLOBAL_", n, nil, nil)
+
+	target := task.Target{Name: "flaky", Up: []string{"false"}}
+	ce.Handle(task.ExecutionTask{Target: target, Path: "."})
+	n.Wait()
+	target.Up = []string{"true"}
+	ce.Handle(task.ExecutionTask{Target: target, Path: "."})
+	n.Wait()
+	ce.Handle(task.ExecutionTask{Target: target, Path: "."})
+	n.Wait()
+
+	assert.Equal(t, []string{notify.EventFailure, notify.EventRecovery}, kinds)
+}
+
+func TestCommandExecutorTracing(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	assert.NoError(t, tracing.Enable(collector.URL, "host"))
+	defer tracing.Shutdown()
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ce := NewCommandExecutor(&memory.MemorySecrets{}, false, "pico", "GLOBAL_", nil, nil, nil)
+	ce.Handle(task.ExecutionTask{
+		Target: task.Target{Name: "traced", Up: []string{"sh", "-c", "echo $TRACEPARENT"}},
+		Path:   ".",
+		Env:    map[string]string{tracing.EnvVar: parent},
+	})
+
+	// the command is given the execute span, a child in the same trace
+	traceparent := strings.TrimSpace(string(ce.Output("traced")))
+	assert.Regexp(t, "^00-0af7651916cd43dd8448eb211c80319c-[0-9a-f]{16}-01$", traceparent)
+	assert.NotEqual(t, parent, traceparent)
+}
+
+func TestCommandExecutorRedactsOutput(t *testing.T) {
+	store := secret.Redacted(&memory.MemorySecrets{
+		Secrets: map[string]map[string]string{
+			"leaky": map[string]string{"API_TOKEN": "tok-0f8e2a91"},
+		},
+	})
+	ce := NewCommandExecutor(store, false, "pico", "GLOBAL_", nil, nil, nil)
+	ce.Handle(task.ExecutionTask{
+		Target: task.Target{Name: "leaky", Up: []string{"sh", "-c", "printf 'token is %s' $API_TOKEN"}},
+		Path:   ".",
+	})
+
+	assert.Equal(t, "token is [REDACTED]", string(ce.Output("leaky")))
+}
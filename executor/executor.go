@@ -10,3 +10,9 @@ import "github.com/picostack/pico/task"
 type Executor interface {
 	Subscribe(chan task.ExecutionTask)
 }
+
+// Listener is told the outcome of each task once it has been executed, so the
+// watcher can record what's actually deployed.
+type Listener interface {
+	Finished(t task.ExecutionTask, err error)
+}
@@ -0,0 +1,37 @@
+package executor
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// headCommit returns the hash of the commit currently checked out at path.
+func headCommit(path string) (string, error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open repository")
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read HEAD")
+	}
+	return ref.Hash().String(), nil
+}
+
+// checkout hard-resets the repository at path to the given commit, wiping any
+// changes in the working tree.
+func checkout(path, hash string) error {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open repository")
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return errors.Wrap(err, "failed to get worktree")
+	}
+	return wt.Reset(&git.ResetOptions{
+		Commit: plumbing.NewHash(hash),
+		Mode:   git.HardReset,
+	})
+}
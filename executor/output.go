@@ -0,0 +1,31 @@
+package executor
+
+import (
+	"sync"
+)
+
+// outputLimit is how much of each target's most recent output is kept
+const outputLimit = 64 * 1024
+
+// output keeps the tail of everything written to it so the most recent output
+// of a target's commands can be retrieved while the daemon is running.
+type output struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.buf = append(o.buf, p...)
+	if over := len(o.buf) - outputLimit; over > 0 {
+		o.buf = append(o.buf[:0:0], o.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (o *output) Bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]byte(nil), o.buf...)
+}
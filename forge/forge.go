@@ -0,0 +1,251 @@
+// Package forge reports the outcome of deploying a commit back to the Git forge
+// the commit came from, as a commit status. This shows developers whether their
+// change was deployed right next to the commit or pull request. GitHub, GitLab
+// and Gitea are supported, each target opts in with `commit_status` set to the
+// forge its repository is hosted on.
+package forge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+
+	"github.com/picostack/pico/logger"
+	"github.com/picostack/pico/task"
+)
+
+// Forges statuses can be reported to
+const (
+	GitHub = "github"
+	GitLab = "gitlab"
+	Gitea  = "gitea"
+)
+
+// States of a commit status
+const (
+	StatePending = "pending"
+	StateSuccess = "success"
+	StateFailure = "failure"
+)
+
+// maxDescription is the longest description GitHub accepts
+const maxDescription = 140
+
+// AuthResolver returns the credentials for a target's repository
+type AuthResolver func(task.Target) (transport.AuthMethod, error)
+
+// Reporter sets commit statuses for targets that ask for them. Statuses are set
+// in the background, one at a time and in order, so the status of a commit
+// always ends up as its final outcome.
+type Reporter struct {
+	hostname string
+	auth     AuthResolver
+	client   *http.Client
+	statuses chan status
+	wg       sync.WaitGroup
+}
+
+type status struct {
+	target      task.Target
+	commit      string
+	state       string
+	description string
+}
+
+// New creates a reporter that identifies statuses with the hostname and sets
+// them with the credentials returned by auth.
+func New(hostname string, auth AuthResolver) *Reporter {
+	r := &Reporter{
+		hostname: hostname,
+		auth:     auth,
+		client:   &http.Client{Timeout: time.Second * 10},
+		statuses: make(chan status, 64),
+	}
+	go r.run()
+	return r
+}
+
+// Pending reports that the task's commit is being deployed
+func (r *Reporter) Pending(t task.ExecutionTask) {
+	if r == nil {
+		return
+	}
+	r.report(t, StatePending, fmt.Sprintf("deploying on %s", r.hostname))
+}
+
+// Done reports whether the task's commit was deployed successfully
+func (r *Reporter) Done(t task.ExecutionTask, err error) {
+	if r == nil {
+		return
+	}
+	if err != nil {
+		r.report(t, StateFailure, logger.Redact(fmt.Sprintf("failed on %s: %v", r.hostname, err)))
+		return
+	}
+	r.report(t, StateSuccess, fmt.Sprintf("deployed on %s", r.hostname))
+}
+
+// Wait blocks until every status that was reported has been sent
+func (r *Reporter) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Reporter) report(t task.ExecutionTask, state, description string) {
+	if t.Target.CommitStatus == "" || t.Shutdown {
+		return
+	}
+	commit := t.Env["PICO_COMMIT_SHA"]
+	if commit == "" {
+		return
+	}
+	if len(description) > maxDescription {
+		description = description[:maxDescription-3] + "..."
+	}
+	r.wg.Add(1)
+	select {
+	case r.statuses <- status{t.Target, commit, state, description}:
+	default:
+		r.wg.Done()
+		zap.L().Warn("too many pending commit statuses, dropping status",
+			zap.String("target", t.Target.Name),
+			zap.String("state", state))
+	}
+}
+
+func (r *Reporter) run() {
+	for s := range r.statuses {
+		if err := r.send(s); err != nil {
+			zap.L().Warn("failed to set commit status",
+				zap.String("target", s.target.Name),
+				zap.String("commit", s.commit),
+				zap.String("state", s.state),
+				zap.Error(err))
+		}
+		r.wg.Done()
+	}
+}
+
+func (r *Reporter) send(s status) error {
+	auth, err := r.auth(s.target)
+	if err != nil {
+		return errors.Wrap(err, "failed to get credentials")
+	}
+	basic, ok := auth.(*githttp.BasicAuth)
+	if !ok {
+		return errors.New("commit statuses need the target to use username and password credentials")
+	}
+	base, repo, err := parseRepoURL(s.target.RepoURL)
+	if err != nil {
+		return err
+	}
+
+	name := "pico/" + r.hostname
+	var req *http.Request
+	switch s.target.CommitStatus {
+	case GitHub:
+		api := base + "/api/v3"
+		if base == "https://github.com" {
+			api = "https://api.github.com"
+		}
+		req, err = jsonRequest(fmt.Sprintf("%s/repos/%s/statuses/%s", api, repo, s.commit), map[string]string{
+			"state":       s.state,
+			"description": s.description,
+			"context":     name,
+		})
+		if err == nil {
+			req.SetBasicAuth(basic.Username, basic.Password)
+		}
+
+	case GitLab:
+		state := s.state
+		if state == StateFailure {
+			state = "failed"
+		}
+		q := url.Values{}
+		q.Set("state", state)
+		q.Set("name", name)
+		q.Set("description", s.description)
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s?%s",
+			base, url.PathEscape(repo), s.commit, q.Encode()), nil)
+		if err == nil {
+			req.Header.Set("PRIVATE-TOKEN", basic.Password)
+		}
+
+	case Gitea:
+		req, err = jsonRequest(fmt.Sprintf("%s/api/v1/repos/%s/statuses/%s", base, repo, s.commit), map[string]string{
+			"state":       s.state,
+			"description": s.description,
+			"context":     name,
+		})
+		if err == nil {
+			req.SetBasicAuth(basic.Username, basic.Password)
+		}
+
+	default:
+		return errors.Errorf("unknown forge '%s'", s.target.CommitStatus)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to set commit status")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+func jsonRequest(url string, body interface{}) (*http.Request, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// parseRepoURL splits a repository URL into the base URL of the forge and the
+// path of the repository on it. SSH URLs are assumed to be served over HTTPS.
+func parseRepoURL(repoURL string) (base, repo string, err error) {
+	if !strings.Contains(repoURL, "://") {
+		// scp-like syntax, such as git@github.com:picostack/pico.git
+		if i := strings.Index(repoURL, ":"); i != -1 {
+			repoURL = "ssh://" + repoURL[:i] + "/" + repoURL[i+1:]
+		}
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to parse repository URL")
+	}
+	scheme := u.Scheme
+	if scheme != "http" {
+		scheme = "https"
+	}
+	repo = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if u.Hostname() == "" || repo == "" {
+		return "", "", errors.Errorf("repository URL '%s' does not name a repository on a forge", repoURL)
+	}
+	host := u.Hostname()
+	if u.Port() != "" && u.Scheme != "ssh" {
+		host = u.Host
+	}
+	return scheme + "://" + host, repo, nil
+}
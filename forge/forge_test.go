@@ -0,0 +1,154 @@
+package forge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+
+	"github.com/picostack/pico/logger"
+	"github.com/picostack/pico/task"
+)
+
+type request struct {
+	path  string
+	query string
+	auth  string
+	token string
+	body  map[string]string
+}
+
+func TestReporter(t *testing.T) {
+	var mu sync.Mutex
+	requests := []request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{
+			path:  r.URL.Path,
+			query: r.URL.RawQuery,
+			token: r.Header.Get("PRIVATE-TOKEN"),
+		}
+		if user, pass, ok := r.BasicAuth(); ok {
+			req.auth = user + ":" + pass
+		}
+		json.NewDecoder(r.Body).Decode(&req.body) //nolint:errcheck
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	r := New("host", func(task.Target) (transport.AuthMethod, error) {
+		return &githttp.BasicAuth{Username: "user", Password: "token"}, nil
+	})
+	env := map[string]string{"PICO_COMMIT_SHA": "abc123"}
+
+	github := task.ExecutionTask{Target: task.Target{Name: "app", RepoURL: server.URL + "/org/app.git", CommitStatus: GitHub}, Env: env}
+	r.Pending(github)
+	r.Done(github, errors.New("exit status 1"))
+
+	gitlab := task.ExecutionTask{Target: task.Target{Name: "app", RepoURL: server.URL + "/group/app", CommitStatus: GitLab}, Env: env}
+	r.Done(gitlab, nil)
+
+	gitea := task.ExecutionTask{Target: task.Target{Name: "app", RepoURL: server.URL + "/org/app", CommitStatus: Gitea}, Env: env}
+	r.Done(gitea, nil)
+
+	// targets that don't ask for statuses and shutdowns are not reported
+	r.Done(task.ExecutionTask{Target: task.Target{Name: "quiet", RepoURL: server.URL + "/org/quiet"}, Env: env}, nil)
+	r.Done(task.ExecutionTask{Target: gitea.Target, Env: env, Shutdown: true}, nil)
+	r.Wait()
+
+	require.Len(t, requests, 4)
+
+	assert.Equal(t, "/api/v3/repos/org/app/statuses/abc123", requests[0].path)
+	assert.Equal(t, "user:token", requests[0].auth)
+	assert.Equal(t, map[string]string{"state": "pending", "description": "deploying on host", "context": "pico/host"}, requests[0].body)
+	assert.Equal(t, "failure", requests[1].body["state"])
+	assert.Equal(t, "failed on host: exit status 1", requests[1].body["description"])
+
+	assert.Equal(t, "/api/v4/projects/group/app/statuses/abc123", requests[2].path)
+	assert.Equal(t, "token", requests[2].token)
+	assert.Contains(t, requests[2].query, "state=success")
+	assert.Contains(t, requests[2].query, "name=pico%2Fhost")
+
+	assert.Equal(t, "/api/v1/repos/org/app/statuses/abc123", requests[3].path)
+	assert.Equal(t, "success", requests[3].body["state"])
+}
+
+func TestReporterDescriptionLength(t *testing.T) {
+	var description string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body) //nolint:errcheck
+		description = body["description"]
+	}))
+	defer server.Close()
+
+	r := New("host", func(task.Target) (transport.AuthMethod, error) {
+		return &githttp.BasicAuth{Username: "user", Password: "token"}, nil
+	})
+	r.Done(task.ExecutionTask{
+		Target: task.Target{RepoURL: server.URL + "/org/app", CommitStatus: Gitea},
+		Env:    map[string]string{"PICO_COMMIT_SHA": "abc123"},
+	}, errors.New(strings.Repeat("x", 200)))
+	r.Wait()
+
+	assert.Len(t, description, maxDescription)
+}
+
+func TestReporterRedactsErrors(t *testing.T) {
+	var description string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body) //nolint:errcheck
+		description = body["description"]
+	}))
+	defer server.Close()
+	logger.AddSecrets("forge-secret")
+
+	r := New("host", func(task.Target) (transport.AuthMethod, error) {
+		return &githttp.BasicAuth{Username: "user", Password: "token"}, nil
+	})
+	r.Done(task.ExecutionTask{
+		Target: task.Target{RepoURL: server.URL + "/org/app", CommitStatus: Gitea},
+		Env:    map[string]string{"PICO_COMMIT_SHA": "abc123"},
+	}, errors.New("bad token forge-secret"))
+	r.Wait()
+
+	assert.Equal(t, "failed on host: bad token "+logger.Redacted, description)
+}
+
+func TestParseRepoURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		base    string
+		repo    string
+		wantErr bool
+	}{
+		{"https://github.com/picostack/pico", "https://github.com", "picostack/pico", false},
+		{"https://github.com/picostack/pico.git", "https://github.com", "picostack/pico", false},
+		{"git@github.com:picostack/pico.git", "https://github.com", "picostack/pico", false},
+		{"ssh://git@gitlab.example.com:2222/group/sub/app.git", "https://gitlab.example.com", "group/sub/app", false},
+		{"http://gitea.local:3000/org/app", "http://gitea.local:3000", "org/app", false},
+		{"../test.local", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			base, repo, err := parseRepoURL(tt.url)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.base, base)
+			assert.Equal(t, tt.repo, repo)
+		})
+	}
+}
@@ -42,6 +42,11 @@ func init() {
 	var c cfg
 	envconfig.MustProcess("", &c)
 
+	if err := zap.RegisterSink("redacted", newSink); err != nil {
+		fmt.Println("Error during logging config:", err)
+		os.Exit(1)
+	}
+
 	var config zap.Config
 	if c.Environment == EnvironmentDev || isInTests() {
 		config = zap.NewDevelopmentConfig()
@@ -50,6 +55,8 @@ func init() {
 	}
 
 	config.Level.SetLevel(c.LogLevel)
+	config.OutputPaths = redactedPaths(config.OutputPaths)
+	config.ErrorOutputPaths = redactedPaths(config.ErrorOutputPaths)
 	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
 	logger, err := config.Build()
@@ -0,0 +1,176 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted is what secret values are replaced with
+const Redacted = "[REDACTED]"
+
+// minSecretLength is the shortest value that's redacted, masking shorter values
+// such as "1" or "yes" would mangle unrelated output without hiding anything.
+const minSecretLength = 4
+
+// flushThreshold is how much of a single line a Writer holds before writing it
+// out anyway, so output without newlines isn't buffered forever.
+const flushThreshold = 64 * 1024
+
+var (
+	secretsMu sync.RWMutex
+	secrets   = make(map[string]struct{})
+	replacer  *strings.Replacer // nil until there's something to redact
+)
+
+// AddSecrets registers values that must never appear in the logs or in the
+// output of commands. Both the value and its JSON-escaped form are redacted.
+func AddSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	added := false
+	for _, v := range values {
+		if len(v) < minSecretLength {
+			continue
+		}
+		for _, form := range []string{v, jsonEscaped(v)} {
+			if _, ok := secrets[form]; !ok {
+				secrets[form] = struct{}{}
+				added = true
+			}
+		}
+	}
+	if !added {
+		return
+	}
+
+	// longest first, so a secret that contains another is masked as a whole
+	all := make([]string, 0, len(secrets))
+	for s := range secrets {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool { return len(all[i]) > len(all[j]) })
+	pairs := make([]string, 0, len(all)*2)
+	for _, s := range all {
+		pairs = append(pairs, s, Redacted)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact masks every known secret in s
+func Redact(s string) string {
+	secretsMu.RLock()
+	r := replacer
+	secretsMu.RUnlock()
+	if r == nil {
+		return s
+	}
+	return r.Replace(s)
+}
+
+func jsonEscaped(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return s
+	}
+	return string(b[1 : len(b)-1])
+}
+
+// Writer masks known secrets in everything written through it. It works a line
+// at a time so secrets split across writes are still masked, Flush must be
+// called once writing has finished to write out the final partial line.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter creates a writer that redacts secrets before writing to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write implements io.Writer
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	end := bytes.LastIndexByte(w.buf, '\n') + 1
+	if end == 0 && len(w.buf) < flushThreshold {
+		return len(p), nil
+	}
+	if end == 0 {
+		end = len(w.buf)
+	}
+	if err := w.write(end); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out anything held back waiting for the end of a line
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(len(w.buf))
+}
+
+func (w *Writer) write(n int) error {
+	if n == 0 {
+		return nil
+	}
+	line := Redact(string(w.buf[:n]))
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	_, err := io.WriteString(w.w, line)
+	return err
+}
+
+// sink redacts each log entry before it's written, zap writes every entry with
+// a single call so secrets are never split.
+type sink struct {
+	zapcore.WriteSyncer
+	close func()
+}
+
+func (s sink) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.WriteSyncer, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s sink) Close() error {
+	s.close()
+	return nil
+}
+
+// newSink opens the log destination named by a `redacted:` URL, such as
+// `redacted:stderr`, and redacts everything written to it.
+func newSink(u *url.URL) (zap.Sink, error) {
+	path := u.Opaque
+	if path == "" {
+		path = u.Path
+	}
+	ws, closeSink, err := zap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return sink{ws, closeSink}, nil
+}
+
+func redactedPaths(paths []string) []string {
+	redacted := make([]string, len(paths))
+	for i, p := range paths {
+		redacted[i] = "redacted:" + p
+	}
+	return redacted
+}
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRedact(t *testing.T) {
+	AddSecrets("", "abc", "hunter22", "hunter22-and-more", `pass"word`)
+
+	assert.Equal(t, "abc [REDACTED] [REDACTED]", Redact("abc hunter22 hunter22-and-more"))
+	assert.Equal(t, `[REDACTED] and [REDACTED]`, Redact(`pass"word and pass\"word`))
+	assert.Equal(t, "nothing secret", Redact("nothing secret"))
+}
+
+func TestWriter(t *testing.T) {
+	AddSecrets("s3cr3t-token")
+
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	for _, chunk := range []string{"token: s3cr", "3t-token\nsecond ", "line s3cr3t-", "token"} {
+		n, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, "token: [REDACTED]\n", out.String())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "token: [REDACTED]\nsecond line [REDACTED]", out.String())
+}
+
+func TestSink(t *testing.T) {
+	AddSecrets("vault-token-value")
+
+	dir, err := ioutil.TempDir("", "pico-logger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+
+	config := zap.NewProductionConfig()
+	config.OutputPaths = redactedPaths([]string{path})
+	logger, err := config.Build()
+	require.NoError(t, err)
+
+	logger.Info("connecting",
+		zap.String("token", "vault-token-value"),
+		zap.Any("env", map[string]string{"TOKEN": "vault-token-value"}))
+	require.NoError(t, logger.Sync())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "vault-token-value")
+	assert.Contains(t, string(b), `"token":"[REDACTED]"`)
+	assert.Contains(t, string(b), `"TOKEN":"[REDACTED]"`)
+}
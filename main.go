@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -15,9 +18,12 @@ import (
 	"github.com/urfave/cli"
 	"go.uber.org/zap"
 
+	"github.com/picostack/pico/events"
 	_ "github.com/picostack/pico/logger"
 	"github.com/picostack/pico/service"
 	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/tracing"
+	"github.com/picostack/pico/watchdog"
 )
 
 var version = "master"
@@ -50,11 +56,27 @@ this repository has new commits, Pico will automatically reconfigure.`,
 				cli.DurationFlag{Name: "pass-env", EnvVar: "PASS_ENV"},
 				cli.BoolFlag{Name: "ssh", EnvVar: "SSH"},
 				cli.DurationFlag{Name: "check-interval", EnvVar: "CHECK_INTERVAL", Value: time.Second * 10},
+				cli.DurationFlag{Name: "config-check-interval", EnvVar: "CONFIG_CHECK_INTERVAL"},
+				cli.DurationFlag{Name: "check-jitter", EnvVar: "CHECK_JITTER"},
 				cli.StringFlag{Name: "vault-addr", EnvVar: "VAULT_ADDR"},
 				cli.StringFlag{Name: "vault-token", EnvVar: "VAULT_TOKEN"},
 				cli.StringFlag{Name: "vault-path", EnvVar: "VAULT_PATH", Value: "/secret"},
 				cli.DurationFlag{Name: "vault-renew-interval", EnvVar: "VAULT_RENEW_INTERVAL", Value: time.Hour * 24},
 				cli.StringFlag{Name: "vault-config-path", EnvVar: "VAULT_CONFIG_PATH", Value: "pico"},
+				cli.StringFlag{Name: "webhook-addr", EnvVar: "WEBHOOK_ADDR"},
+				cli.StringFlag{Name: "webhook-secret", EnvVar: "WEBHOOK_SECRET"},
+				cli.DurationFlag{Name: "watchdog-threshold", EnvVar: "WATCHDOG_THRESHOLD", Value: time.Minute * 5},
+				cli.BoolFlag{Name: "graceful-shutdown", EnvVar: "GRACEFUL_SHUTDOWN"},
+				cli.StringFlag{Name: "metrics-addr", EnvVar: "METRICS_ADDR"},
+				cli.StringFlag{Name: "control-socket", EnvVar: "CONTROL_SOCKET"},
+				cli.DurationFlag{Name: "shutdown-timeout", EnvVar: "SHUTDOWN_TIMEOUT", Value: time.Minute * 5},
+				cli.StringFlag{Name: "smtp-addr", EnvVar: "SMTP_ADDR"},
+				cli.StringFlag{Name: "smtp-username", EnvVar: "SMTP_USERNAME"},
+				cli.StringFlag{Name: "smtp-password", EnvVar: "SMTP_PASSWORD"},
+				cli.StringFlag{Name: "smtp-from", EnvVar: "SMTP_FROM"},
+				cli.StringFlag{Name: "audit-log", EnvVar: "AUDIT_LOG"},
+				cli.StringFlag{Name: "audit-webhook", EnvVar: "AUDIT_WEBHOOK"},
+				cli.StringFlag{Name: "otlp-endpoint", EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT"},
 			},
 			Action: func(c *cli.Context) (err error) {
 				if !c.Args().Present() {
@@ -74,22 +96,52 @@ this repository has new commits, Pico will automatically reconfigure.`,
 					}
 				}
 
+				// The config repository is checked at the same rate as targets
+				// unless a separate interval is given.
+				configInterval := c.Duration("config-check-interval")
+				if configInterval == 0 {
+					configInterval = c.Duration("check-interval")
+				}
+
+				// The control socket lives in the cache directory by default so
+				// the client commands can find it.
+				controlSocket := c.String("control-socket")
+				if controlSocket == "" {
+					controlSocket = filepath.Join(c.String("directory"), ".pico.sock")
+				}
+
 				cfg := service.Config{
 					Target: task.Repo{
 						URL:  c.Args().First(),
 						User: c.String("git-username"),
 						Pass: c.String("git-password"),
 					},
-					Hostname:        hostname,
-					Directory:       c.String("directory"),
-					PassEnvironment: c.Bool("pass-env"),
-					SSH:             c.Bool("ssh"),
-					CheckInterval:   c.Duration("check-interval"),
-					VaultAddress:    c.String("vault-addr"),
-					VaultToken:      c.String("vault-token"),
-					VaultPath:       c.String("vault-path"),
-					VaultRenewal:    c.Duration("vault-renew-interval"),
-					VaultConfig:     c.String("vault-config-path"),
+					Hostname:          hostname,
+					Directory:         c.String("directory"),
+					PassEnvironment:   c.Bool("pass-env"),
+					SSH:               c.Bool("ssh"),
+					CheckInterval:     c.Duration("check-interval"),
+					ConfigInterval:    configInterval,
+					CheckJitter:       c.Duration("check-jitter"),
+					VaultAddress:      c.String("vault-addr"),
+					VaultToken:        c.String("vault-token"),
+					VaultPath:         c.String("vault-path"),
+					VaultRenewal:      c.Duration("vault-renew-interval"),
+					VaultConfig:       c.String("vault-config-path"),
+					WebhookAddress:    c.String("webhook-addr"),
+					WebhookSecret:     c.String("webhook-secret"),
+					WatchdogThreshold: c.Duration("watchdog-threshold"),
+					GracefulShutdown:  c.Bool("graceful-shutdown"),
+					ShutdownTimeout:   c.Duration("shutdown-timeout"),
+					MetricsAddress:    c.String("metrics-addr"),
+					ControlSocket:     controlSocket,
+					SMTPAddress:       c.String("smtp-addr"),
+					SMTPUsername:      c.String("smtp-username"),
+					SMTPPassword:      c.String("smtp-password"),
+					SMTPFrom:          c.String("smtp-from"),
+					AuditLog:          c.String("audit-log"),
+					AuditWebhook:      c.String("audit-webhook"),
+					OTLPEndpoint:      c.String("otlp-endpoint"),
 				}
 
 				zap.L().Debug("initialising service", zap.Any("config", cfg))
@@ -105,16 +157,39 @@ this repository has new commits, Pico will automatically reconfigure.`,
 				go func() { errs <- svc.Start(ctx) }()
 
 				s := make(chan os.Signal, 1)
-				signal.Notify(s, os.Interrupt)
+				signal.Notify(s, os.Interrupt, syscall.SIGTERM)
 
 				select {
 				case <-ctx.Done():
 					err = ctx.Err()
 				case sig := <-s:
 					err = errors.New(sig.String())
+					if !cfg.GracefulShutdown {
+						break
+					}
+
+					// a second signal skips the rest of the graceful shutdown
+					zap.L().Info("received signal, shutting down gracefully",
+						zap.String("signal", sig.String()),
+						zap.Duration("timeout", cfg.ShutdownTimeout))
+					done := make(chan error, 1)
+					go func() { done <- svc.Shutdown(cfg.ShutdownTimeout) }()
+					select {
+					case err = <-done:
+					case sig = <-s:
+						err = errors.Errorf("graceful shutdown interrupted by %s", sig)
+					}
 				case err = <-errs:
 				}
 
+				// make sure notifications, commit statuses, the audit trail and
+				// traces are complete before exiting
+				if ferr := svc.Flush(cfg.ShutdownTimeout); ferr != nil {
+					zap.L().Warn("failed to flush notifications", zap.Error(ferr))
+				}
+				events.Close()
+				tracing.Shutdown()
+
 				if strings.ToLower(os.Getenv("LOG_LEVEL")) == "debug" {
 					doTrace()
 				}
@@ -122,6 +197,129 @@ this repository has new commits, Pico will automatically reconfigure.`,
 				return
 			},
 		},
+		{
+			Name:        "status",
+			Description: `Shows the status of the running Pico daemon.`,
+			Usage:       "show the status of the running daemon.",
+			Flags:       clientFlags,
+			Action: func(c *cli.Context) error {
+				s, err := newClient(c).Status()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintf(w, "hostname:\t%s\n", s.Hostname)
+				fmt.Fprintf(w, "config:\t%s\n", s.ConfigURL)
+				fmt.Fprintf(w, "config commit:\t%s\n", s.ConfigCommit)
+				fmt.Fprintf(w, "last reconfigure:\t%s\n", since(s.LastReconfigure))
+				fmt.Fprintf(w, "targets:\t%d\n", s.Targets)
+				fmt.Fprintf(w, "queued tasks:\t%d\n", s.QueueDepth)
+				fmt.Fprintf(w, "paused:\t%t\n", s.Paused)
+				for _, p := range s.Stuck {
+					fmt.Fprintf(w, "stuck:\t%s for %s\n", p.Name, time.Since(p.Since).Round(time.Second))
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:        "targets",
+			Description: `Lists the targets of the running Pico daemon and the result of their last run.`,
+			Usage:       "list targets and the result of their last run.",
+			Flags:       clientFlags,
+			Action: func(c *cli.Context) error {
+				targets, err := newClient(c).Targets()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tBRANCH\tCOMMIT\tDEPLOYED\tLAST RUN\tRESULT")
+				for _, t := range targets {
+					branch := t.Branch
+					if branch == "" {
+						branch = "-"
+					}
+					if t.Paused {
+						branch += " (paused)"
+					}
+					lastRun, result := "-", "-"
+					if t.LastRun != nil {
+						lastRun = since(t.LastRun.Started)
+						result = t.LastRun.Action + " " + t.LastRun.Result
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+						t.Name, branch, short(t.Commit), short(t.Deployed), lastRun, result)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:        "trigger",
+			Description: `Runs a target's up command against its current commit.`,
+			Usage:       "argument `target` specifies the target to run.",
+			ArgsUsage:   "target",
+			Flags:       clientFlags,
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					cli.ShowCommandHelp(c, "trigger")
+					return errors.New("missing argument: target name")
+				}
+				if err := newClient(c).Trigger(c.Args().First()); err != nil {
+					return err
+				}
+				fmt.Printf("triggered %s\n", c.Args().First())
+				return nil
+			},
+		},
+		{
+			Name: "pause",
+			Description: `Stops Pico from running a target, or every target if none is given.
+Repositories are still watched and the latest commit is applied once they
+are resumed. Every target can also be paused by creating a file named
+.pico-pause in the directory.`,
+			Usage:     "optional argument `target` specifies the target to pause.",
+			ArgsUsage: "[target]",
+			Flags:     clientFlags,
+			Action: func(c *cli.Context) error {
+				if err := newClient(c).Pause(c.Args().First()); err != nil {
+					return err
+				}
+				fmt.Println("paused", describeTarget(c.Args().First()))
+				return nil
+			},
+		},
+		{
+			Name:        "resume",
+			Description: `Resumes a paused target, or every target if none is given.`,
+			Usage:       "optional argument `target` specifies the target to resume.",
+			ArgsUsage:   "[target]",
+			Flags:       clientFlags,
+			Action: func(c *cli.Context) error {
+				if err := newClient(c).Resume(c.Args().First()); err != nil {
+					return err
+				}
+				fmt.Println("resumed", describeTarget(c.Args().First()))
+				return nil
+			},
+		},
+		{
+			Name:        "logs",
+			Description: `Prints the most recent output of a target's commands.`,
+			Usage:       "argument `target` specifies the target to print output of.",
+			ArgsUsage:   "target",
+			Flags:       clientFlags,
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					cli.ShowCommandHelp(c, "logs")
+					return errors.New("missing argument: target name")
+				}
+				b, err := newClient(c).Logs(c.Args().First())
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(b)
+				return err
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -130,6 +328,45 @@ this repository has new commits, Pico will automatically reconfigure.`,
 	}
 }
 
+// clientFlags locate the control socket of the daemon for the client commands,
+// they default to the same values as the `run` command.
+var clientFlags = []cli.Flag{
+	cli.StringFlag{Name: "directory", EnvVar: "DIRECTORY", Value: "./cache/"},
+	cli.StringFlag{Name: "control-socket", EnvVar: "CONTROL_SOCKET"},
+}
+
+func newClient(c *cli.Context) *service.Client {
+	socket := c.String("control-socket")
+	if socket == "" {
+		socket = filepath.Join(c.String("directory"), ".pico.sock")
+	}
+	return service.NewClient(socket)
+}
+
+func describeTarget(name string) string {
+	if name == "" {
+		return "all targets"
+	}
+	return name
+}
+
+func short(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	if sha == "" {
+		return "-"
+	}
+	return sha
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
 var waitpoints = regexp.MustCompile(`__waitpoint__(.+)\(`)
 
 func doTrace() {
@@ -142,5 +379,9 @@ func doTrace() {
 	for _, s := range waitpoints.FindAllStringSubmatch(string(buf[:stacklen]), 1) {
 		fmt.Printf("  - %s\n", s[1])
 	}
+	fmt.Println("Waitpoints that were blocked:")
+	for _, w := range watchdog.Stuck(0) {
+		fmt.Printf("  - %s for %s\n", w.Name, time.Since(w.Since))
+	}
 	fmt.Println("\nSee the docs on https://pico.sh/ for more information.")
 }
@@ -0,0 +1,116 @@
+// Package metrics defines the Prometheus metrics pico exposes and the HTTP
+// listener that serves them. The metrics are registered with the default
+// registry so they can be updated from anywhere without being passed around.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const namespace = "pico"
+
+// Results used to label outcomes
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultSkipped = "skipped"
+)
+
+var (
+	// Reconfigurations counts the states the watcher has applied
+	Reconfigurations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconfigurations_total",
+		Help:      "Number of configuration states applied.",
+	})
+
+	// LastReconfiguration is the time the watcher last applied a state
+	LastReconfiguration = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_reconfiguration_timestamp_seconds",
+		Help:      "Unix time the last configuration state was applied.",
+	})
+
+	// ConfigFailures counts failures to evaluate the configuration scripts
+	ConfigFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_failures_total",
+		Help:      "Number of times the configuration could not be evaluated.",
+	})
+
+	// GitFetchDuration observes how long fetches made by pico take
+	GitFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "git_fetch_duration_seconds",
+		Help:      "Duration of Git fetches, by repository.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"repo"})
+
+	// GitErrors counts errors from watching repositories
+	GitErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "git_errors_total",
+		Help:      "Number of errors fetching or checking out repositories, by repository.",
+	}, []string{"repo"})
+
+	// Executions counts the tasks run for each target
+	Executions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "executions_total",
+		Help:      "Number of target executions, by target, action and result.",
+	}, []string{"target", "action", "result"})
+
+	// ExecutionDuration observes how long each target's tasks take
+	ExecutionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "execution_duration_seconds",
+		Help:      "Duration of target executions, by target and action.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"target", "action"})
+
+	// VaultRenewals counts attempts to renew the Vault token
+	VaultRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vault_token_renewals_total",
+		Help:      "Number of Vault token renewals, by result.",
+	}, []string{"result"})
+
+	// VaultTokenTTL is the remaining lifetime of the Vault token when it was
+	// last looked up or renewed
+	VaultTokenTTL = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vault_token_ttl_seconds",
+		Help:      "TTL of the Vault token as of the last lookup or renewal.",
+	})
+)
+
+// Action returns the action label for a task
+func Action(shutdown bool) string {
+	if shutdown {
+		return "down"
+	}
+	return "up"
+}
+
+// Gauge registers a gauge whose value is read from fn whenever it's scraped
+func Gauge(name, help string, fn func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// ListenAndServe serves the metrics over HTTP on /metrics and blocks until it
+// fails
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	zap.L().Info("metrics listener started", zap.String("address", addr))
+	return http.ListenAndServe(addr, mux)
+}
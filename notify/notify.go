@@ -0,0 +1,232 @@
+// Package notify sends notifications about deployments to the destinations
+// declared in the config repository with `N()`. Notifications are sent when a
+// target's commands fail, when they succeed again after failing, and when the
+// configuration could not be evaluated and the previous state is kept.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/picostack/pico/logger"
+)
+
+// Kinds of event
+const (
+	EventFailure        = "failure"         // a target's commands failed
+	EventRecovery       = "recovery"        // a target's commands succeeded after failing
+	EventConfigFallback = "config_fallback" // the config failed to evaluate
+)
+
+// Types of destination
+const (
+	TypeWebhook = "webhook" // the event is posted as JSON
+	TypeSlack   = "slack"   // Slack and Mattermost incoming webhooks
+	TypeDiscord = "discord" // Discord webhooks
+	TypeTeams   = "teams"   // Microsoft Teams incoming webhooks
+	TypeEmail   = "email"   // email sent via the SMTP server pico is configured with
+)
+
+// Rule declares where to send notifications and which events to send
+type Rule struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	URL     string   `json:"url"`     // for every type except email
+	To      []string `json:"to"`      // recipients of emails
+	Targets []string `json:"targets"` // only notify about these targets, all if empty
+	Events  []string `json:"events"`  // only notify about these events, all if empty
+}
+
+// Event describes something worth notifying about
+type Event struct {
+	Kind     string    `json:"kind"`
+	Target   string    `json:"target,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Hostname string    `json:"hostname"`
+	Time     time.Time `json:"time"`
+}
+
+// SMTP configures the server emails are sent through
+type SMTP struct {
+	Address  string // host:port
+	Username string
+	Password string `json:"-"`
+	From     string
+}
+
+// Notifier sends events to the destinations of the rules that match them
+type Notifier struct {
+	hostname string
+	smtp     SMTP
+	client   *http.Client
+
+	mu    sync.Mutex
+	rules []Rule
+	wg    sync.WaitGroup
+}
+
+// New creates a notifier for the host, with no rules until SetRules is called
+func New(hostname string, smtp SMTP) *Notifier {
+	return &Notifier{
+		hostname: hostname,
+		smtp:     smtp,
+		client:   &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// SetRules replaces the rules, it's called whenever a new state is generated
+func (n *Notifier) SetRules(rules []Rule) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules = rules
+}
+
+// Notify sends the event to every destination with a matching rule. Sending
+// happens in the background so slow destinations don't hold up deployments,
+// failures are only logged.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	e.Hostname = n.hostname
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	n.mu.Lock()
+	rules := n.rules
+	n.mu.Unlock()
+
+	for _, r := range rules {
+		if !r.matches(e) {
+			continue
+		}
+		n.wg.Add(1)
+		go func(r Rule) {
+			defer n.wg.Done()
+			if err := n.send(r, e); err != nil {
+				zap.L().Warn("failed to send notification",
+					zap.String("rule", r.Name),
+					zap.String("type", r.Type),
+					zap.String("event", e.Kind),
+					zap.Error(err))
+			}
+		}(r)
+	}
+}
+
+// Wait blocks until every notification that's being sent has been
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+func (r Rule) matches(e Event) bool {
+	return (len(r.Events) == 0 || contains(r.Events, e.Kind)) &&
+		(len(r.Targets) == 0 || e.Target == "" || contains(r.Targets, e.Target))
+}
+
+func (n *Notifier) send(r Rule, e Event) error {
+	e.Error = logger.Redact(e.Error)
+	switch r.Type {
+	case TypeWebhook:
+		return n.post(r.URL, e)
+	case TypeSlack, TypeTeams:
+		return n.post(r.URL, map[string]string{"text": e.Message()})
+	case TypeDiscord:
+		return n.post(r.URL, map[string]string{"content": e.Message()})
+	case TypeEmail:
+		return n.email(r.To, e)
+	}
+	return errors.Errorf("unknown notification type '%s'", r.Type)
+}
+
+func (n *Notifier) post(url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode notification")
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "failed to post notification")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) email(to []string, e Event) error {
+	if n.smtp.Address == "" {
+		return errors.New("no SMTP server configured")
+	}
+	var auth smtp.Auth
+	if n.smtp.Username != "" {
+		host := n.smtp.Address
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.smtp.Username, n.smtp.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.smtp.From,
+		strings.Join(to, ", "),
+		e.Subject(),
+		e.Message())
+	return errors.Wrap(
+		smtp.SendMail(n.smtp.Address, auth, n.smtp.From, to, []byte(msg)),
+		"failed to send email")
+}
+
+// Subject summarises the event in a single line
+func (e Event) Subject() string {
+	switch e.Kind {
+	case EventFailure:
+		return fmt.Sprintf("%s failed on %s", e.Target, e.Hostname)
+	case EventRecovery:
+		return fmt.Sprintf("%s recovered on %s", e.Target, e.Hostname)
+	case EventConfigFallback:
+		return fmt.Sprintf("config failed on %s", e.Hostname)
+	}
+	return fmt.Sprintf("%s on %s", e.Kind, e.Hostname)
+}
+
+// Message describes the event in a sentence or two
+func (e Event) Message() string {
+	commit := e.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	switch e.Kind {
+	case EventFailure:
+		return fmt.Sprintf("pico: `%s` of %s failed on %s at %s: %s", e.Action, e.Target, e.Hostname, commit, e.Error)
+	case EventRecovery:
+		return fmt.Sprintf("pico: `%s` of %s succeeded again on %s at %s", e.Action, e.Target, e.Hostname, commit)
+	case EventConfigFallback:
+		return fmt.Sprintf("pico: the config could not be evaluated on %s, the previous state was kept: %s", e.Hostname, e.Error)
+	}
+	return "pico: " + e.Subject()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
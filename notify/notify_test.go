@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/logger"
+)
+
+// recorder collects the bodies of the requests it receives, by path
+type recorder struct {
+	server *httptest.Server
+	bodies map[string][]string
+}
+
+func newRecorder() *recorder {
+	r := &recorder{bodies: make(map[string][]string)}
+	received := make(chan struct{}, 1)
+	received <- struct{}{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		<-received
+		r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], string(b))
+		received <- struct{}{}
+	}))
+	return r
+}
+
+func TestNotify(t *testing.T) {
+	r := newRecorder()
+	defer r.server.Close()
+
+	n := New("host", SMTP{})
+	n.SetRules([]Rule{
+		{Name: "all", Type: TypeWebhook, URL: r.server.URL + "/webhook"},
+		{Name: "app", Type: TypeSlack, URL: r.server.URL + "/slack", Targets: []string{"app"}},
+		{Name: "failures", Type: TypeDiscord, URL: r.server.URL + "/discord", Events: []string{EventFailure, EventConfigFallback}},
+	})
+
+	n.Notify(Event{Kind: EventFailure, Target: "app", Action: "up", Commit: "0123456789", Error: "exit status 1"})
+	n.Notify(Event{Kind: EventRecovery, Target: "db", Action: "up", Commit: "0123456789"})
+	n.Notify(Event{Kind: EventConfigFallback, Error: "syntax error"})
+	n.Wait()
+
+	require.Len(t, r.bodies["/webhook"], 3)
+	require.Len(t, r.bodies["/slack"], 2)
+	require.Len(t, r.bodies["/discord"], 2)
+
+	var e Event
+	for _, b := range r.bodies["/webhook"] {
+		require.NoError(t, json.Unmarshal([]byte(b), &e))
+		assert.Equal(t, "host", e.Hostname)
+		assert.False(t, e.Time.IsZero())
+	}
+	assert.Contains(t, r.bodies["/slack"], `{"text":"pico: `+"`up`"+` of app failed on host at 0123456: exit status 1"}`)
+	assert.Contains(t, r.bodies["/discord"], `{"content":"pico: the config could not be evaluated on host, the previous state was kept: syntax error"}`)
+}
+
+func TestNotifyRedactsErrors(t *testing.T) {
+	r := newRecorder()
+	defer r.server.Close()
+	logger.AddSecrets("notify-secret")
+
+	n := New("host", SMTP{})
+	n.SetRules([]Rule{
+		{Type: TypeWebhook, URL: r.server.URL + "/webhook"},
+		{Type: TypeSlack, URL: r.server.URL + "/slack"},
+	})
+	n.Notify(Event{Kind: EventFailure, Target: "app", Action: "up", Error: "bad token notify-secret"})
+	n.Wait()
+
+	require.Len(t, r.bodies["/webhook"], 1)
+	require.Len(t, r.bodies["/slack"], 1)
+	for _, b := range append(r.bodies["/webhook"], r.bodies["/slack"]...) {
+		assert.NotContains(t, b, "notify-secret")
+		assert.Contains(t, b, logger.Redacted)
+	}
+}
+
+func TestNotifyNil(t *testing.T) {
+	var n *Notifier
+	n.SetRules([]Rule{{Type: TypeWebhook, URL: "http://localhost"}})
+	n.Notify(Event{Kind: EventFailure})
+}
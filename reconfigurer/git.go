@@ -8,9 +8,15 @@ import (
 	"github.com/Southclaws/gitwatch"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 
 	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/events"
+	"github.com/picostack/pico/metrics"
+	"github.com/picostack/pico/notify"
+	"github.com/picostack/pico/tracing"
+	"github.com/picostack/pico/watchdog"
 	"github.com/picostack/pico/watcher"
 )
 
@@ -23,9 +29,12 @@ type GitProvider struct {
 	hostname      string
 	configRepo    string
 	checkInterval time.Duration
+	checkJitter   time.Duration
 	authMethod    transport.AuthMethod
+	notifier      *notify.Notifier
 
-	configWatcher *gitwatch.Session
+	configWatcher *watcher.BranchSession
+	syncs         chan struct{}
 }
 
 // New creates a new provider with all necessary parameters
@@ -34,119 +43,217 @@ func New(
 	hostname string,
 	configRepo string,
 	checkInterval time.Duration,
+	checkJitter time.Duration,
 	authMethod transport.AuthMethod,
+	notifier *notify.Notifier,
 ) *GitProvider {
 	return &GitProvider{
 		directory:     directory,
 		hostname:      hostname,
 		configRepo:    configRepo,
 		checkInterval: checkInterval,
+		checkJitter:   checkJitter,
 		authMethod:    authMethod,
+		notifier:      notifier,
+		syncs:         make(chan struct{}, 1),
 	}
 }
 
 // Configure implements Provider
 func (p *GitProvider) Configure(w watcher.Watcher) error {
+	if err := p.watchConfig(); err != nil {
+		return err
+	}
+
 	if err := p.reconfigure(w); err != nil {
 		return err
 	}
 
-	for range p.configWatcher.Events {
+	for {
+		select {
+		case <-p.configWatcher.Events:
+		case <-p.syncs:
+			zap.L().Debug("config sync requested")
+			changed, err := p.fetch()
+			if err != nil {
+				zap.L().Error("failed to sync config repository", zap.Error(err))
+				continue
+			}
+			if !changed {
+				continue
+			}
+		}
 		if err := p.reconfigure(w); err != nil {
 			return err
 		}
 	}
+}
 
-	return nil
+// Sync implements webhook.Syncer, it reconfigures immediately if the config
+// repository matches. Requests made while one is already pending are dropped.
+func (p *GitProvider) Sync(match func(url string) bool) {
+	if !match(p.configRepo) {
+		return
+	}
+	select {
+	case p.syncs <- struct{}{}:
+	default:
+	}
 }
 
-// reconfigure will close the configuration watcher (unless it's the first run)
-// then create a watcher for the application's config target repo then wait for
-// the first event (either from a fresh clone, a pull, or just a noop event)
-// then update the state of the watcher it's in charge of.
+// reconfigure generates a new desired state from the config repository, which
+// the config watcher keeps up to date, then updates the state of the watcher
+// it's in charge of.
 func (p *GitProvider) reconfigure(w watcher.Watcher) (err error) {
 	zap.L().Debug("reconfiguring")
 
-	err = p.watchConfig()
-	if err != nil {
-		return
-	}
+	ctx, span := tracing.Start(context.Background(), "reconfigure")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttribute("repo", p.configRepo)
 
-	// generate a new desired state from the config repo
-	path, err := gitwatch.GetRepoDirectory(p.configRepo)
+	path, err := p.getConfigPath()
 	if err != nil {
 		return
 	}
-	state := getNewState(
-		filepath.Join(p.directory, path),
+	commit, _ := p.Commit()
+	span.SetAttribute("commit", commit)
+	events.Publish(events.Event{Type: events.ConfigFetched, Repo: p.configRepo, Commit: commit})
+
+	state, cerr := getNewState(
+		ctx,
+		path,
 		p.hostname,
 		w.GetState(),
 	)
 
+	evaluated := events.Event{Type: events.ConfigEvaluated, Repo: p.configRepo, Commit: commit, Result: metrics.ResultSuccess}
+	if cerr != nil {
+		evaluated.Result = metrics.ResultFailure
+		evaluated.Error = cerr.Error()
+	}
+	events.Publish(evaluated)
+
+	// the rules come from the state, so a broken config keeps the old rules
+	p.notifier.SetRules(state.Notifications)
+	if cerr != nil {
+		p.notifier.Notify(notify.Event{
+			Kind:  notify.EventConfigFallback,
+			Error: cerr.Error(),
+		})
+	}
+
 	// Set the HOSTNAME config environment variable if necessary.
 	if p.hostname != "" {
+		if state.Env == nil {
+			state.Env = make(map[string]string)
+		}
 		state.Env["HOSTNAME"] = p.hostname
 	}
 
 	zap.L().Debug("setting state for watcher",
 		zap.Any("new_state", state))
 
+	// watchers that support it record applying the state in the same trace
+	if tw, ok := w.(interface {
+		SetStateContext(context.Context, config.State) error
+	}); ok {
+		return tw.SetStateContext(ctx, state)
+	}
 	return w.SetState(state)
 }
 
-// watchConfig creates or restarts the watcher that reacts to changes to the
-// repo that contains pico configuration scripts
-func (p *GitProvider) watchConfig() (err error) {
-	if p.configWatcher != nil {
-		zap.L().Debug("closing existing watcher")
-		p.configWatcher.Close()
+// fetch pulls the config repository immediately instead of waiting for the
+// config watcher's next check, it returns true if there were any changes. The
+// config watcher serialises this with its own checks.
+func (p *GitProvider) fetch() (bool, error) {
+	event, err := p.configWatcher.Pull()
+	if err != nil {
+		return false, err
 	}
+	return event != nil, nil
+}
 
-	p.configWatcher, err = gitwatch.New(
+// Commit returns the commit the config repository is currently at
+func (p *GitProvider) Commit() (string, error) {
+	path, err := p.getConfigPath()
+	if err != nil {
+		return "", err
+	}
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open config repository")
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get config repository head")
+	}
+	return head.Hash().String(), nil
+}
+
+func (p *GitProvider) getConfigPath() (string, error) {
+	path, err := gitwatch.GetRepoDirectory(p.configRepo)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(p.directory, path), nil
+}
+
+// watchConfig creates the watcher that reacts to changes to the repo that
+// contains pico configuration scripts and waits for the initial clone or pull.
+// The watcher runs for the lifetime of the provider.
+func (p *GitProvider) watchConfig() (err error) {
+	path, err := p.getConfigPath()
+	if err != nil {
+		return err
+	}
+	p.configWatcher, err = watcher.NewBranchSession(
 		context.TODO(),
-		[]gitwatch.Repository{{URL: p.configRepo}},
-		p.checkInterval,
-		p.directory,
+		p.configRepo,
+		"",
+		path,
 		p.authMethod,
-		false)
-	p.configWatcher.UseForce = true
+		p.checkInterval,
+		p.checkJitter)
 	if err != nil {
 		return errors.Wrap(err, "failed to watch config target")
 	}
 
-	errs := make(chan error)
+	zap.L().Debug("created new config watcher, awaiting setup")
+
+	if err = p.__waitpoint__watch_config(); err != nil {
+		return
+	}
+	go p.configWatcher.Run()
 	go func() {
-		e := p.configWatcher.Run()
-		if e != nil && !errors.Is(e, context.Canceled) {
-			errs <- e
-		}
 		// TODO: forward these errors elsewhere.
-		for e = range p.configWatcher.Errors {
+		for e := range p.configWatcher.Errors {
+			metrics.GitErrors.WithLabelValues(p.configRepo).Inc()
 			zap.L().Error("config watcher error occurred", zap.Error(e))
 		}
 	}()
-	zap.L().Debug("created new config watcher, awaiting setup")
-
-	err = p.__waitpoint__watch_config(errs)
 
 	zap.L().Debug("config watcher initialised")
 
 	return
 }
 
-func (p *GitProvider) __waitpoint__watch_config(errs chan error) (err error) {
-	select {
-	case <-p.configWatcher.InitialDone:
-	case err = <-errs:
-	}
-	return
+func (p *GitProvider) __waitpoint__watch_config() error {
+	defer watchdog.Enter("watch_config")()
+	return p.configWatcher.Sync()
 }
 
 // getNewState attempts to obtain a new desired state from the given path, if
-// any failures occur, it simply returns a fallback state and logs an error
-func getNewState(path, hostname string, fallback config.State) (state config.State) {
-	state, err := config.ConfigFromDirectory(path, hostname)
+// any failures occur, it simply returns a fallback state along with the error
+func getNewState(ctx context.Context, path, hostname string, fallback config.State) (state config.State, err error) {
+	_, span := tracing.Start(ctx, "config.evaluate")
+	state, err = config.ConfigFromDirectory(path, hostname)
+	span.SetError(err)
+	span.End()
 	if err != nil {
+		metrics.ConfigFailures.Inc()
 		zap.L().Error("failed to construct config from repo, falling back to original state",
 			zap.String("path", path),
 			zap.String("hostname", hostname),
@@ -0,0 +1,21 @@
+package secret
+
+import "github.com/picostack/pico/logger"
+
+// Redacted wraps a store so the value of every secret it returns is masked in
+// the logs and in the output of commands.
+func Redacted(s Store) Store {
+	return redacted{s}
+}
+
+type redacted struct {
+	Store
+}
+
+func (r redacted) GetSecretsForTarget(name string) (map[string]string, error) {
+	secrets, err := r.Store.GetSecretsForTarget(name)
+	for _, v := range secrets {
+		logger.AddSecrets(v)
+	}
+	return secrets, err
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"github.com/picostack/pico/metrics"
 	"github.com/picostack/pico/secret"
 )
 
@@ -43,9 +44,11 @@ func New(addr, basepath, token string, renewal time.Duration) (v *VaultSecrets,
 	}
 	v.client.SetToken(token)
 
-	if _, err = v.client.Auth().Token().LookupSelf(); err != nil {
+	self, err := v.client.Auth().Token().LookupSelf()
+	if err != nil {
 		return nil, errors.Wrap(err, "failed to connect to vault server")
 	}
+	recordTTL(self)
 
 	// engine is the first component of base, then the rest is the actual path.
 	v.enginepath, v.path = splitPath(basepath)
@@ -104,12 +107,16 @@ func (v *VaultSecrets) Renew(ctx context.Context) error {
 	for range renew.C {
 		token, err := v.client.Auth().Token().RenewSelf(0)
 		if err != nil {
+			metrics.VaultRenewals.WithLabelValues(metrics.ResultFailure).Inc()
 			return errors.Wrap(err, "failed to renew vault token")
 		}
 		if _, err = v.client.Auth().Token().LookupSelf(); err != nil {
+			metrics.VaultRenewals.WithLabelValues(metrics.ResultFailure).Inc()
 			return errors.Wrap(err, "failed to connect to vault server")
 		}
 		v.client.SetToken(token.Auth.ClientToken)
+		metrics.VaultRenewals.WithLabelValues(metrics.ResultSuccess).Inc()
+		recordTTL(token)
 		zap.L().Debug("renewed fault token",
 			zap.String("lease_id", token.LeaseID),
 			zap.Int("lease_duration", token.LeaseDuration),
@@ -118,6 +125,15 @@ func (v *VaultSecrets) Renew(ctx context.Context) error {
 	return nil
 }
 
+func recordTTL(s *api.Secret) {
+	ttl, err := s.TokenTTL()
+	if err != nil {
+		zap.L().Debug("could not read vault token ttl", zap.Error(err))
+		return
+	}
+	metrics.VaultTokenTTL.Set(ttl.Seconds())
+}
+
 func splitPath(basepath string) (string, string) {
 	basepath = strings.Trim(basepath, "/")
 	s := strings.SplitN(basepath, "/", 2)
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/picostack/pico/executor"
+	"github.com/picostack/pico/watchdog"
+	"github.com/picostack/pico/watcher"
+)
+
+// Status describes the daemon as a whole, served by the control API
+type Status struct {
+	Hostname        string               `json:"hostname"`
+	ConfigURL       string               `json:"config_url"`
+	ConfigCommit    string               `json:"config_commit,omitempty"`
+	LastReconfigure time.Time            `json:"last_reconfigure"`
+	Targets         int                  `json:"targets"`
+	QueueDepth      int                  `json:"queue_depth"`
+	Paused          bool                 `json:"paused"`
+	Stuck           []watchdog.Waitpoint `json:"stuck_waitpoints,omitempty"`
+}
+
+// TargetStatus describes a single target, served by the control API
+type TargetStatus struct {
+	Name     string              `json:"name"`
+	URL      string              `json:"url"`
+	Branch   string              `json:"branch,omitempty"`
+	Commit   string              `json:"commit,omitempty"`   // last commit deployed
+	Deployed string              `json:"deployed,omitempty"` // last commit that passed its health check
+	Paused   bool                `json:"paused"`
+	LastRun  *executor.RunStatus `json:"last_run,omitempty"`
+}
+
+// ServeAPI serves the control API on a Unix socket at the given path and blocks
+// until it fails. The socket is only accessible to the user pico runs as since
+// the API can run targets.
+func (app *App) ServeAPI(path string) error {
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	zap.L().Info("control API started", zap.String("socket", path))
+	return http.Serve(l, app.apiHandler())
+}
+
+// listenPrivate listens on a Unix socket that only the current user can access.
+// The socket is created in a private directory and only moved into place once
+// its permissions are set, so there's no window where anyone else can connect.
+// A socket left behind by a previous run is replaced.
+func listenPrivate(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create directory for control socket")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to remove stale control socket")
+	}
+
+	private, err := ioutil.TempDir(filepath.Dir(path), ".pico-sock")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create private directory for control socket")
+	}
+	defer os.RemoveAll(private)
+
+	tmp := filepath.Join(private, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen on control socket")
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err != nil {
+		l.Close() //nolint:errcheck
+		return nil, errors.Wrap(err, "failed to set control socket permissions")
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		l.Close() //nolint:errcheck
+		return nil, errors.Wrap(err, "failed to move control socket into place")
+	}
+	return l, nil
+}
+
+func (app *App) apiHandler() http.Handler {
+	gw := app.watcher.(*watcher.GitWatcher)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", get(func(r *http.Request) (interface{}, error) {
+		return app.status(gw), nil
+	}))
+	mux.HandleFunc("/state", get(func(r *http.Request) (interface{}, error) {
+		return gw.GetState(), nil
+	}))
+	mux.HandleFunc("/targets", get(func(r *http.Request) (interface{}, error) {
+		return app.targets(gw), nil
+	}))
+	mux.HandleFunc("/sync", post(func(r *http.Request) error {
+		all := func(string) bool { return true }
+		gw.Sync(all)
+		if s, ok := app.reconfigurer.(interface{ Sync(func(string) bool) }); ok {
+			s.Sync(all)
+		}
+		return nil
+	}))
+	mux.HandleFunc("/pause", post(func(r *http.Request) error {
+		return gw.PauseAll()
+	}))
+	mux.HandleFunc("/resume", post(func(r *http.Request) error {
+		return gw.ResumeAll()
+	}))
+	mux.HandleFunc("/targets/", app.targetHandler(gw))
+	return mux
+}
+
+// targetHandler serves `/targets/{name}`, its `logs` and the `run`, `pause`
+// and `resume` actions below it.
+func (app *App) targetHandler(gw *watcher.GitWatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/targets/"), "/")
+		name := parts[0]
+
+		if len(parts) == 1 {
+			get(func(r *http.Request) (interface{}, error) {
+				for _, t := range app.targets(gw) {
+					if t.Name == name {
+						return t, nil
+					}
+				}
+				return nil, watcher.ErrUnknownTarget
+			})(w, r)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "logs" {
+			app.logsHandler(gw, name)(w, r)
+			return
+		}
+
+		actions := map[string]func(string) error{
+			"run":    gw.Trigger,
+			"pause":  gw.Pause,
+			"resume": gw.Resume,
+		}
+		action, ok := actions[parts[1]]
+		if len(parts) != 2 || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		post(func(r *http.Request) error {
+			return action(name)
+		})(w, r)
+	}
+}
+
+// logsHandler serves the recent output of a target's commands as plain text
+func (app *App) logsHandler(gw *watcher.GitWatcher, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		found := false
+		for _, t := range gw.GetState().Targets {
+			found = found || t.Name == name
+		}
+		if !found {
+			writeError(w, watcher.ErrUnknownTarget)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(app.executor.Output(name)) //nolint:errcheck
+	}
+}
+
+func (app *App) status(gw *watcher.GitWatcher) Status {
+	s := Status{
+		Hostname:        app.config.Hostname,
+		ConfigURL:       app.config.Target.URL,
+		LastReconfigure: gw.LastReconfigure(),
+		Targets:         len(gw.GetState().Targets),
+		QueueDepth:      gw.QueueLength() + len(app.bus),
+		Paused:          gw.PausedAll(),
+	}
+	if c, ok := app.reconfigurer.(interface{ Commit() (string, error) }); ok {
+		s.ConfigCommit, _ = c.Commit()
+	}
+	if app.config.WatchdogThreshold > 0 {
+		s.Stuck = watchdog.Stuck(app.config.WatchdogThreshold)
+	}
+	return s
+}
+
+func (app *App) targets(gw *watcher.GitWatcher) []TargetStatus {
+	commits := gw.Commits()
+	deployed := app.executor.Deployed()
+	statuses := app.executor.Statuses()
+
+	targets := []TargetStatus{}
+	for _, t := range gw.GetState().Targets {
+		ts := TargetStatus{
+			Name:     t.Name,
+			URL:      t.RepoURL,
+			Branch:   t.Branch,
+			Commit:   commits[t.Name],
+			Deployed: deployed[t.Name],
+			Paused:   gw.Paused(t.Name),
+		}
+		if s, ok := statuses[t.Name]; ok {
+			ts.LastRun = &s
+		}
+		targets = append(targets, ts)
+	}
+	return targets
+}
+
+func get(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := fn(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v) //nolint:errcheck
+	}
+}
+
+func post(fn func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := fn(r); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if err == watcher.ErrUnknownTarget {
+		code = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/executor"
+	"github.com/picostack/pico/secret/memory"
+	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/watcher"
+
+	_ "github.com/picostack/pico/logger"
+)
+
+// testApp starts a watcher with a single target, `app`, cloned from a local
+// repository and returns an App to serve the API from along with the commit the
+// target is on.
+func testApp(t *testing.T, dir string) (*App, string) {
+
+	upstream := filepath.Join(dir, "upstream")
+	repo, err := git.PlainInit(upstream, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upstream, "file"), []byte("file"), 0644))
+	_, err = wt.Add("file")
+	require.NoError(t, err)
+	sha, err := wt.Commit("file", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@pico.sh", When: time.Now()},
+	})
+	require.NoError(t, err)
+
+	bus := make(chan task.ExecutionTask, 16)
+	gw := watcher.NewGitWatcher(filepath.Join(dir, "cache"), bus, time.Hour, 0, nil)
+	go gw.Start() //nolint:errcheck
+	require.NoError(t, gw.SetState(config.State{Targets: []task.Target{
+		{Name: "app", RepoURL: upstream, Up: []string{"echo", "hello"}},
+	}}))
+	ex := executor.NewCommandExecutor(&memory.MemorySecrets{}, false, "", "", nil, nil, gw)
+	ex.Handle(<-bus)
+
+	return &App{
+		watcher:  gw,
+		executor: ex,
+		bus:      bus,
+	}, sha.String()
+}
+
+func TestControlAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-api")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	app, sha := testApp(t, dir)
+	gw := app.watcher.(*watcher.GitWatcher)
+	bus := app.bus
+
+	server := httptest.NewServer(app.apiHandler())
+	defer server.Close()
+
+	var targets []TargetStatus
+	res, err := http.Get(server.URL + "/targets")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&targets))
+	res.Body.Close()
+	require.Len(t, targets, 1)
+	assert.Equal(t, "app", targets[0].Name)
+	assert.Equal(t, sha, targets[0].Commit)
+	assert.False(t, targets[0].Paused)
+
+	res, err = http.Post(server.URL+"/targets/app/pause", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.True(t, gw.Paused("app"))
+
+	// running a paused target holds the task until it's resumed
+	res, err = http.Post(server.URL+"/targets/app/run", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	select {
+	case <-bus:
+		t.Fatal("paused target was run")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res, err = http.Post(server.URL+"/targets/app/resume", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	select {
+	case ex := <-bus:
+		assert.Equal(t, task.TriggerManual, ex.Env["PICO_TRIGGER"])
+	case <-time.After(time.Second):
+		t.Fatal("held task was not run on resume")
+	}
+
+	res, err = http.Post(server.URL+"/targets/missing/run", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(server.URL + "/targets/app/run")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-api")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	app, sha := testApp(t, dir)
+	socket := filepath.Join(dir, "pico.sock")
+	go app.ServeAPI(socket) //nolint:errcheck
+
+	client := NewClient(socket)
+	require.Eventually(t, func() bool {
+		_, err := client.Status()
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	targets, err := client.Targets()
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, sha, targets[0].Commit)
+
+	require.NoError(t, client.Trigger("app"))
+	app.executor.Handle(<-app.bus)
+
+	// the output of the initial deployment and the triggered run
+	logs, err := client.Logs("app")
+	require.NoError(t, err)
+	assert.Equal(t, "hello\nhello\n", string(logs))
+
+	targets, err = client.Targets()
+	require.NoError(t, err)
+	require.NotNil(t, targets[0].LastRun)
+	assert.Equal(t, "success", targets[0].LastRun.Result)
+	assert.Equal(t, task.TriggerManual, targets[0].LastRun.Trigger)
+
+	assert.EqualError(t, client.Trigger("missing"), "unknown target")
+	_, err = client.Logs("missing")
+	assert.Error(t, err)
+}
+
+func TestListenPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a socket left behind by a previous run is replaced
+	socket := filepath.Join(dir, "pico.sock")
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0666))
+
+	l, err := listenPrivate(socket)
+	require.NoError(t, err)
+	defer l.Close()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket|0600, info.Mode())
+
+	// nothing but the socket is left in the directory
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	conn.Close()
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Client talks to the control API of a running daemon over its Unix socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client for the control socket at the given path
+func NewClient(socket string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the status of the daemon
+func (c *Client) Status() (s Status, err error) {
+	err = c.get("/status", &s)
+	return
+}
+
+// Targets returns the status of each target
+func (c *Client) Targets() (t []TargetStatus, err error) {
+	err = c.get("/targets", &t)
+	return
+}
+
+// Logs returns the recent output of a target's commands
+func (c *Client) Logs(target string) ([]byte, error) {
+	return c.do(http.MethodGet, targetPath(target, "logs"))
+}
+
+// Trigger runs a target's `up` command against its current commit
+func (c *Client) Trigger(target string) error {
+	_, err := c.do(http.MethodPost, targetPath(target, "run"))
+	return err
+}
+
+// Pause stops a target from being executed, or every target if it's empty
+func (c *Client) Pause(target string) error {
+	_, err := c.do(http.MethodPost, targetPath(target, "pause"))
+	return err
+}
+
+// Resume lets a target be executed again, or every target if it's empty
+func (c *Client) Resume(target string) error {
+	_, err := c.do(http.MethodPost, targetPath(target, "resume"))
+	return err
+}
+
+func targetPath(target, action string) string {
+	if target == "" {
+		return "/" + action
+	}
+	return "/targets/" + url.PathEscape(target) + "/" + action
+}
+
+func (c *Client) get(path string, v interface{}) error {
+	b, err := c.do(http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(json.Unmarshal(b, v), "failed to decode response")
+}
+
+func (c *Client) do(method, path string) ([]byte, error) {
+	// the host is ignored since every request is sent over the socket
+	req, err := http.NewRequest(method, "http://pico"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to the control socket, is pico running?")
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response")
+	}
+	if res.StatusCode >= 300 {
+		return nil, errors.New(strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
@@ -14,28 +14,52 @@ import (
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 
+	"github.com/picostack/pico/events"
 	"github.com/picostack/pico/executor"
+	"github.com/picostack/pico/forge"
+	"github.com/picostack/pico/logger"
+	"github.com/picostack/pico/metrics"
+	"github.com/picostack/pico/notify"
 	"github.com/picostack/pico/reconfigurer"
 	"github.com/picostack/pico/secret"
 	"github.com/picostack/pico/secret/memory"
 	"github.com/picostack/pico/secret/vault"
 	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/tracing"
+	"github.com/picostack/pico/watchdog"
 	"github.com/picostack/pico/watcher"
+	"github.com/picostack/pico/webhook"
 )
 
 // Config specifies static configuration parameters (from CLI or environment)
 type Config struct {
-	Target          task.Repo
-	Hostname        string
-	SSH             bool
-	Directory       string
-	PassEnvironment bool
-	CheckInterval   time.Duration
-	VaultAddress    string
-	VaultToken      string `json:"-"`
-	VaultPath       string
-	VaultRenewal    time.Duration
-	VaultConfig     string
+	Target            task.Repo
+	Hostname          string
+	SSH               bool
+	Directory         string
+	PassEnvironment   bool
+	CheckInterval     time.Duration
+	ConfigInterval    time.Duration
+	CheckJitter       time.Duration
+	VaultAddress      string
+	VaultToken        string `json:"-"`
+	VaultPath         string
+	VaultRenewal      time.Duration
+	VaultConfig       string
+	WebhookAddress    string
+	WebhookSecret     string `json:"-"`
+	WatchdogThreshold time.Duration
+	GracefulShutdown  bool
+	MetricsAddress    string
+	ControlSocket     string
+	ShutdownTimeout   time.Duration
+	SMTPAddress       string
+	SMTPUsername      string
+	SMTPPassword      string `json:"-"`
+	SMTPFrom          string
+	AuditLog          string
+	AuditWebhook      string
+	OTLPEndpoint      string
 }
 
 // App stores application state
@@ -44,7 +68,13 @@ type App struct {
 	reconfigurer reconfigurer.Provider
 	watcher      watcher.Watcher
 	secrets      secret.Store
+	executor     *executor.CommandExecutor
+	notifier     *notify.Notifier
+	reporter     *forge.Reporter
 	bus          chan task.ExecutionTask
+	drained      chan struct{} // closed once the executor has emptied the bus
+
+	webhookSecret string
 }
 
 // Initialise prepares an instance of the app to run
@@ -53,12 +83,15 @@ func Initialise(c Config) (app *App, err error) {
 
 	app.config = c
 
+	// credentials from the static config, secrets from the store are added as
+	// they're read
+	logger.AddSecrets(c.VaultToken, c.WebhookSecret, c.SMTPPassword, c.Target.Pass)
+
 	var secretStore secret.Store
 	if c.VaultAddress != "" {
 		zap.L().Debug("connecting to vault",
 			zap.String("address", c.VaultAddress),
 			zap.String("path", c.VaultPath),
-			zap.String("token", c.VaultToken),
 			zap.Duration("renewal", c.VaultRenewal))
 
 		secretStore, err = vault.New(c.VaultAddress, c.VaultPath, c.VaultToken, c.VaultRenewal)
@@ -71,6 +104,9 @@ func Initialise(c Config) (app *App, err error) {
 		}
 	}
 
+	app.secrets = secretStore
+	secretStore = secret.Redacted(secretStore)
+
 	secretConfig, err := secretStore.GetSecretsForTarget(c.VaultConfig)
 	if err != nil {
 		zap.L().Info("could not read additional config from vault", zap.String("path", c.VaultConfig))
@@ -83,26 +119,62 @@ func Initialise(c Config) (app *App, err error) {
 		return nil, errors.Wrap(err, "failed to create an authentication method from the given config")
 	}
 
-	app.secrets = secretStore
+	app.webhookSecret = c.WebhookSecret
+	if app.webhookSecret == "" {
+		app.webhookSecret = secretConfig["WEBHOOK_SECRET"]
+	}
+
+	events.SetHostname(c.Hostname)
+	if c.AuditLog != "" {
+		sink, err := events.NewFileSink(c.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		events.Subscribe("file", sink)
+	}
+	if c.AuditWebhook != "" {
+		events.Subscribe("webhook", events.NewWebhookSink(c.AuditWebhook))
+	}
+	if c.OTLPEndpoint != "" {
+		if err = tracing.Enable(c.OTLPEndpoint, c.Hostname); err != nil {
+			return nil, err
+		}
+	}
 
 	app.bus = make(chan task.ExecutionTask, 100)
+	app.drained = make(chan struct{})
 
-	// reconfigurer
-	app.reconfigurer = reconfigurer.New(
-		c.Directory,
-		c.Hostname,
-		c.Target.URL,
-		c.CheckInterval,
-		authMethod,
-	)
+	app.notifier = notify.New(c.Hostname, notify.SMTP{
+		Address:  c.SMTPAddress,
+		Username: c.SMTPUsername,
+		Password: c.SMTPPassword,
+		From:     c.SMTPFrom,
+	})
 
 	// target watcher
-	app.watcher = watcher.NewGitWatcher(
+	gw := watcher.NewGitWatcher(
 		app.config.Directory,
 		app.bus,
 		app.config.CheckInterval,
+		app.config.CheckJitter,
 		secretStore,
 	)
+	app.watcher = gw
+
+	app.reporter = forge.New(c.Hostname, gw.AuthForTarget)
+
+	app.executor = executor.NewCommandExecutor(secretStore, c.PassEnvironment, c.VaultConfig, "GLOBAL_", app.notifier, app.reporter, gw)
+
+	// reconfigurer
+	app.reconfigurer = reconfigurer.New(
+		c.Directory,
+		c.Hostname,
+		c.Target.URL,
+		c.ConfigInterval,
+		c.CheckJitter,
+		authMethod,
+		app.notifier,
+	)
 
 	return
 }
@@ -111,9 +183,9 @@ func Initialise(c Config) (app *App, err error) {
 func (app *App) Start(ctx context.Context) error {
 	errs := make(chan error)
 
-	ce := executor.NewCommandExecutor(app.secrets, app.config.PassEnvironment, app.config.VaultConfig, "GLOBAL_")
 	go func() {
-		ce.Subscribe(app.bus)
+		app.executor.Subscribe(app.bus)
+		close(app.drained)
 	}()
 
 	gw := app.watcher.(*watcher.GitWatcher)
@@ -131,6 +203,43 @@ func (app *App) Start(ctx context.Context) error {
 		)
 	}()
 
+	if app.config.WebhookAddress != "" {
+		syncers := []webhook.Syncer{gw}
+		if s, ok := app.reconfigurer.(webhook.Syncer); ok {
+			syncers = append(syncers, s)
+		}
+		hooks := webhook.New(app.webhookSecret, syncers...)
+		go func() {
+			errs <- errors.Wrap(
+				hooks.ListenAndServe(app.config.WebhookAddress),
+				"webhook listener failed",
+			)
+		}()
+	}
+
+	if app.config.WatchdogThreshold > 0 {
+		go watchdog.Run(ctx, app.config.WatchdogThreshold)
+	}
+
+	// the control API is only a convenience, deployments carry on without it
+	if app.config.ControlSocket != "" {
+		go func() {
+			zap.L().Error("control API failed",
+				zap.String("socket", app.config.ControlSocket),
+				zap.Error(app.ServeAPI(app.config.ControlSocket)))
+		}()
+	}
+
+	if app.config.MetricsAddress != "" {
+		app.registerGauges(gw)
+		go func() {
+			errs <- errors.Wrap(
+				metrics.ListenAndServe(app.config.MetricsAddress),
+				"metrics listener failed",
+			)
+		}()
+	}
+
 	if s, ok := app.secrets.(*vault.VaultSecrets); ok {
 		go func() {
 			errs <- errors.Wrap(
@@ -148,6 +257,74 @@ func (app *App) Start(ctx context.Context) error {
 	}
 }
 
+func (app *App) registerGauges(gw *watcher.GitWatcher) {
+	metrics.Gauge("queue_depth", "Number of tasks waiting to be executed.", func() float64 {
+		return float64(gw.QueueLength() + len(app.bus))
+	})
+	metrics.Gauge("stuck_waitpoints", "Number of waitpoints blocked for longer than the watchdog threshold.", func() float64 {
+		if app.config.WatchdogThreshold <= 0 {
+			return 0
+		}
+		return float64(len(watchdog.Stuck(app.config.WatchdogThreshold)))
+	})
+}
+
+// Shutdown stops watching for changes, waits for every pending task to finish
+// and then runs the `down` commands of all targets that aren't paused in the
+// reverse of the order they were started in, along with sending their
+// notifications. It gives up if this takes longer than the timeout.
+func (app *App) Shutdown(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		app.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		zap.L().Info("graceful shutdown complete")
+		return nil
+	case <-time.After(timeout):
+		return errors.Errorf("graceful shutdown did not complete within %s", timeout)
+	}
+}
+
+func (app *App) shutdown() {
+	gw := app.watcher.(*watcher.GitWatcher)
+
+	zap.L().Info("stopping watcher and waiting for pending tasks")
+	gw.Stop()
+	<-app.drained
+
+	tasks := gw.ShutdownTasks()
+	zap.L().Info("shutting down targets", zap.Int("targets", len(tasks)))
+	for _, t := range tasks {
+		app.executor.Handle(t)
+	}
+
+	app.notifier.Wait()
+	app.reporter.Wait()
+}
+
+// Flush waits for the notifications and commit statuses that are still being
+// sent, so the outcome of the last tasks isn't lost when the daemon exits. It
+// gives up if this takes longer than the timeout.
+func (app *App) Flush(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		app.notifier.Wait()
+		app.reporter.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.Errorf("notifications were not sent within %s", timeout)
+	}
+}
+
 func getAuthMethod(c Config, secretConfig map[string]string) (transport.AuthMethod, error) {
 	if c.SSH {
 		authMethod, err := ssh.NewSSHAgentAuth("git")
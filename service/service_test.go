@@ -0,0 +1,34 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/picostack/pico/forge"
+	"github.com/picostack/pico/notify"
+)
+
+func TestFlush(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	app := &App{
+		notifier: notify.New("host", notify.SMTP{}),
+		reporter: forge.New("host", nil),
+	}
+	app.notifier.SetRules([]notify.Rule{{Type: notify.TypeWebhook, URL: server.URL}})
+	app.notifier.Notify(notify.Event{Kind: notify.EventFailure, Target: "app"})
+
+	// gives up while the notification is still being sent
+	assert.Error(t, app.Flush(50*time.Millisecond))
+
+	close(release)
+	assert.NoError(t, app.Flush(time.Second))
+}
@@ -0,0 +1,72 @@
+package task
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SortTargets orders the targets so that every target comes after the targets
+// it depends on, otherwise keeping the order they were declared in. It fails if
+// a target depends on a target that doesn't exist or the dependencies form a
+// cycle.
+func SortTargets(targets []Target) ([]Target, error) {
+	index := make(map[string]int)
+	for i, t := range targets {
+		index[t.Name] = i
+	}
+	for _, t := range targets {
+		for _, d := range t.DependsOn {
+			if _, ok := index[d]; !ok {
+				return nil, errors.Errorf("target %s depends on unknown target %s", t.Name, d)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(targets))
+	sorted := make([]Target, 0, len(targets))
+	var path []string
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := append(path[indexOf(path, targets[i].Name):], targets[i].Name)
+			return errors.Errorf("dependency cycle between targets: %s", strings.Join(cycle, " -> "))
+		}
+		state[i] = visiting
+		path = append(path, targets[i].Name)
+		for _, d := range targets[i].DependsOn {
+			if err := visit(index[d]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		sorted = append(sorted, targets[i])
+		return nil
+	}
+
+	for i := range targets {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+func indexOf(s []string, v string) int {
+	for i := range s {
+		if s[i] == v {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,50 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func names(targets []Target) (n []string) {
+	for _, t := range targets {
+		n = append(n, t.Name)
+	}
+	return
+}
+
+func TestSortTargets(t *testing.T) {
+	sorted, err := SortTargets([]Target{
+		{Name: "app", DependsOn: []string{"postgres", "redis"}},
+		{Name: "worker", DependsOn: []string{"redis"}},
+		{Name: "redis"},
+		{Name: "postgres"},
+		{Name: "static"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"postgres", "redis", "app", "worker", "static"}, names(sorted))
+
+	// targets without dependencies keep their order
+	sorted, err = SortTargets([]Target{{Name: "b"}, {Name: "a"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "a"}, names(sorted))
+}
+
+func TestSortTargetsErrors(t *testing.T) {
+	_, err := SortTargets([]Target{
+		{Name: "app", DependsOn: []string{"db"}},
+	})
+	assert.EqualError(t, err, "target app depends on unknown target db")
+
+	_, err = SortTargets([]Target{
+		{Name: "a", DependsOn: []string{"b"}},
+		{Name: "b", DependsOn: []string{"c"}},
+		{Name: "c", DependsOn: []string{"a"}},
+	})
+	assert.EqualError(t, err, "dependency cycle between targets: a -> b -> c -> a")
+
+	_, err = SortTargets([]Target{
+		{Name: "a", DependsOn: []string{"a"}},
+	})
+	assert.EqualError(t, err, "dependency cycle between targets: a -> a")
+}
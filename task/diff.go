@@ -2,9 +2,23 @@ package task
 
 import "reflect"
 
-// DiffTargets returns just the additions (also changes) and removals between
-// the specified old targets and new targets
-func DiffTargets(oldTargets, newTargets []Target) (additions, removals []Target) {
+// Diff describes how a set of targets changed between two states
+type Diff struct {
+	Added     []Target
+	Removed   []Target
+	Changed   []Change
+	Unchanged []Target
+}
+
+// Change holds both definitions of a target whose definition changed
+type Change struct {
+	Old Target
+	New Target
+}
+
+// DiffTargets compares the specified old targets with the new targets by name,
+// targets that exist in both but are not identical are changes.
+func DiffTargets(oldTargets, newTargets []Target) (diff Diff) {
 	for _, newTarget := range newTargets {
 		var exists bool
 		for _, oldTarget := range oldTargets {
@@ -14,7 +28,7 @@ func DiffTargets(oldTargets, newTargets []Target) (additions, removals []Target)
 			}
 		}
 		if !exists {
-			additions = append(additions, newTarget)
+			diff.Added = append(diff.Added, newTarget)
 		}
 	}
 	for _, oldTarget := range oldTargets {
@@ -27,10 +41,28 @@ func DiffTargets(oldTargets, newTargets []Target) (additions, removals []Target)
 			}
 		}
 		if !exists {
-			removals = append(removals, oldTarget)
+			diff.Removed = append(diff.Removed, oldTarget)
 		} else if !reflect.DeepEqual(oldTarget, newTarget) {
-			additions = append(additions, newTarget)
+			diff.Changed = append(diff.Changed, Change{Old: oldTarget, New: newTarget})
+		} else {
+			diff.Unchanged = append(diff.Unchanged, newTarget)
 		}
 	}
 	return
 }
+
+// Restart reports whether the old definition should be shut down before the new
+// one is run, according to the new definition's `OnChange` behaviour.
+func (c Change) Restart() bool {
+	switch c.New.OnChange {
+	case OnChangeRestart:
+		return true
+	case OnChangeSource:
+		return c.Old.RepoURL != c.New.RepoURL ||
+			c.Old.Branch != c.New.Branch ||
+			c.Old.Tag != c.New.Tag ||
+			c.Old.Semver != c.New.Semver ||
+			c.Old.Ref != c.New.Ref
+	}
+	return false
+}
@@ -13,9 +13,8 @@ func Test_DiffTargets(t *testing.T) {
 		newTargets []Target
 	}
 	tests := []struct {
-		args          args
-		wantAdditions []Target
-		wantRemovals  []Target
+		args args
+		want Diff
 	}{
 		{
 			args{
@@ -30,8 +29,13 @@ func Test_DiffTargets(t *testing.T) {
 					{Name: "three"},
 				},
 			},
-			nil,
-			nil,
+			Diff{
+				Unchanged: []Target{
+					{Name: "one"},
+					{Name: "two"},
+					{Name: "three"},
+				},
+			},
 		},
 		{
 			args{
@@ -42,12 +46,13 @@ func Test_DiffTargets(t *testing.T) {
 					{Name: "three"},
 				},
 			},
-			[]Target{
-				{Name: "one"},
-				{Name: "two"},
-				{Name: "three"},
+			Diff{
+				Added: []Target{
+					{Name: "one"},
+					{Name: "two"},
+					{Name: "three"},
+				},
 			},
-			nil,
 		},
 		{
 			args{
@@ -58,11 +63,12 @@ func Test_DiffTargets(t *testing.T) {
 				},
 				newTargets: []Target{},
 			},
-			nil,
-			[]Target{
-				{Name: "one"},
-				{Name: "two"},
-				{Name: "three"},
+			Diff{
+				Removed: []Target{
+					{Name: "one"},
+					{Name: "two"},
+					{Name: "three"},
+				},
 			},
 		},
 		{
@@ -77,9 +83,14 @@ func Test_DiffTargets(t *testing.T) {
 					{Name: "three"},
 				},
 			},
-			nil,
-			[]Target{
-				{Name: "two"},
+			Diff{
+				Removed: []Target{
+					{Name: "two"},
+				},
+				Unchanged: []Target{
+					{Name: "one"},
+					{Name: "three"},
+				},
 			},
 		},
 		{
@@ -94,10 +105,15 @@ func Test_DiffTargets(t *testing.T) {
 					{Name: "three"},
 				},
 			},
-			[]Target{
-				{Name: "two"},
+			Diff{
+				Added: []Target{
+					{Name: "two"},
+				},
+				Unchanged: []Target{
+					{Name: "one"},
+					{Name: "three"},
+				},
 			},
-			nil,
 		},
 		{
 			args{
@@ -112,17 +128,44 @@ func Test_DiffTargets(t *testing.T) {
 					{Name: "three"},
 				},
 			},
-			[]Target{
-				{Name: "two", RepoURL: "312"},
+			Diff{
+				Changed: []Change{
+					{Old: Target{Name: "two", RepoURL: "123"}, New: Target{Name: "two", RepoURL: "312"}},
+				},
+				Unchanged: []Target{
+					{Name: "one"},
+					{Name: "three"},
+				},
 			},
-			nil,
 		},
 	}
 	for ii, tt := range tests {
 		t.Run(fmt.Sprint(ii), func(t *testing.T) {
-			gotAdditions, gotRemovals := DiffTargets(tt.args.oldTargets, tt.args.newTargets)
-			assert.Equal(t, tt.wantAdditions, gotAdditions, "additions mismatch")
-			assert.Equal(t, tt.wantRemovals, gotRemovals, "removals mismatch")
+			assert.Equal(t, tt.want, DiffTargets(tt.args.oldTargets, tt.args.newTargets))
 		})
 	}
 }
+
+func TestChangeRestart(t *testing.T) {
+	old := Target{Name: "one", RepoURL: "123", Branch: "main", Env: map[string]string{"A": "1"}}
+
+	env := old
+	env.Env = map[string]string{"A": "2"}
+	branch := old
+	branch.Branch = "dev"
+
+	for _, tt := range []struct {
+		onChange string
+		new      Target
+		want     bool
+	}{
+		{"", env, false},
+		{OnChangeUp, branch, false},
+		{OnChangeRestart, env, true},
+		{OnChangeSource, env, false},
+		{OnChangeSource, branch, true},
+	} {
+		tt.new.OnChange = tt.onChange
+		assert.Equal(t, tt.want, Change{Old: old, New: tt.new}.Restart(), "on_change %q", tt.onChange)
+	}
+}
@@ -0,0 +1,40 @@
+package task
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Duration wraps time.Duration so it can be declared in configuration scripts
+// as either a string such as "30s" or "5m" or a plain number of seconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse duration '%s'", value)
+		}
+		*d = Duration(parsed)
+	case nil:
+		*d = 0
+	default:
+		return errors.Errorf("invalid duration: %s", string(b))
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
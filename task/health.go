@@ -0,0 +1,122 @@
+package task
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHealthInterval = time.Second * 5
+	defaultHealthTimeout  = time.Second * 10
+)
+
+// HealthCheck describes how to verify that a target is actually working after
+// its `Up` command has succeeded. Only one of the check types should be set.
+type HealthCheck struct {
+	// An HTTP(S) URL that must respond with a 2xx status code
+	URL string `json:"url"`
+
+	// A host:port address that must accept TCP connections
+	TCP string `json:"tcp"`
+
+	// A command that must exit successfully
+	Command []string `json:"command"`
+
+	// A shell string that must exit successfully, used instead of `Command`
+	Run string `json:"run"`
+
+	// How many more times to attempt the check after the first failure
+	Retries int `json:"retries"`
+
+	// How long to wait between attempts, defaults to 5 seconds
+	Interval Duration `json:"interval"`
+
+	// How long each attempt may take, defaults to 10 seconds
+	Timeout Duration `json:"timeout"`
+}
+
+// Check runs the health check until it either succeeds or runs out of retries.
+// Command checks are run in the specified directory with the specified env.
+func (h HealthCheck) Check(dir, shell string, env map[string]string, inheritEnv bool, out io.Writer) (err error) {
+	interval := time.Duration(h.Interval)
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := time.Duration(h.Timeout)
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+
+	for i := 0; i <= h.Retries; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		if err = h.attempt(dir, shell, env, inheritEnv, out, timeout); err == nil {
+			return nil
+		}
+	}
+
+	return &UnhealthyError{errors.Wrapf(err, "health check failed after %d attempts", h.Retries+1)}
+}
+
+// UnhealthyError is returned when a health check fails, which sets it apart from
+// a failing command since retrying the same commit won't help.
+type UnhealthyError struct {
+	err error
+}
+
+func (e *UnhealthyError) Error() string { return e.err.Error() }
+
+// Unwrap returns the error from the last attempt
+func (e *UnhealthyError) Unwrap() error { return e.err }
+
+// RedeployedError is returned when a target's commit already failed its health
+// check, so the last healthy commit was deployed in its place.
+type RedeployedError struct {
+	Commit   string // the commit that failed its health check
+	Previous string // the healthy commit that was deployed instead
+}
+
+func (e *RedeployedError) Error() string {
+	return fmt.Sprintf("commit %s previously failed its health check, redeployed %s", e.Commit, e.Previous)
+}
+
+func (h HealthCheck) attempt(dir, shell string, env map[string]string, inheritEnv bool, out io.Writer, timeout time.Duration) error {
+	switch {
+	case h.URL != "":
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(h.URL)
+		if err != nil {
+			return errors.Wrap(err, "failed to perform HTTP request")
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errors.Errorf("unexpected HTTP status: %s", resp.Status)
+		}
+		return nil
+
+	case h.TCP != "":
+		conn, err := net.DialTimeout("tcp", h.TCP, timeout)
+		if err != nil {
+			return errors.Wrap(err, "failed to connect")
+		}
+		return conn.Close()
+
+	case len(h.Command) > 0 || h.Run != "":
+		step := Step{
+			Name:    "healthcheck",
+			Command: h.Command,
+			Run:     h.Run,
+			Shell:   shell,
+			Timeout: Duration(timeout),
+		}
+		return step.execute(dir, env, inheritEnv, out).Err
+	}
+
+	return errors.New("health check does not specify a url, tcp address or command")
+}
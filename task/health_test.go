@@ -0,0 +1,49 @@
+package task
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckHTTP(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	assert.NoError(t, HealthCheck{URL: healthy.URL}.Check(".", "", nil, false, nil))
+	err := HealthCheck{
+		URL:      unhealthy.URL,
+		Retries:  2,
+		Interval: Duration(time.Millisecond),
+	}.Check(".", "", nil, false, nil)
+	assert.IsType(t, &UnhealthyError{}, err)
+	assert.Contains(t, err.Error(), "health check failed after 3 attempts")
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+
+	assert.NoError(t, HealthCheck{TCP: addr}.Check(".", "", nil, false, nil))
+
+	l.Close()
+	assert.Error(t, HealthCheck{TCP: addr}.Check(".", "", nil, false, nil))
+}
+
+func TestHealthCheckCommand(t *testing.T) {
+	assert.NoError(t, HealthCheck{Command: []string{"true"}}.Check(".", "", nil, false, nil))
+	assert.NoError(t, HealthCheck{Run: `test "$STATUS" = "ok"`}.Check(".", "", map[string]string{"STATUS": "ok"}, false, nil))
+	assert.Error(t, HealthCheck{Run: "exit 1", Interval: Duration(time.Millisecond)}.Check(".", "", nil, false, nil))
+	assert.Error(t, HealthCheck{}.Check(".", "", nil, false, nil))
+}
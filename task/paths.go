@@ -0,0 +1,65 @@
+package task
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Matches reports whether any of the given changed files are relevant to the
+// target according to its `Paths` and `IgnorePaths` filters. A file is relevant
+// if it matches one of `Paths` (or `Paths` is empty) and none of `IgnorePaths`.
+func (t *Target) Matches(files []string) bool {
+	for _, f := range files {
+		if len(t.Paths) > 0 && !matchAny(t.Paths, f) {
+			continue
+		}
+		if matchAny(t.IgnorePaths, f) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func matchAny(patterns []string, file string) bool {
+	for _, p := range patterns {
+		if globToRegexp(p).MatchString(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp converts a glob pattern to a regular expression. `*` and `?`
+// match within a single path segment while `**` matches across segments, so
+// `services/api/**` matches every file underneath `services/api`.
+func globToRegexp(pattern string) *regexp.Regexp {
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					sb.WriteString("(.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	return regexp.MustCompile(sb.String())
+}
@@ -0,0 +1,48 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		{"services/api/**", "services/api/main.go", true},
+		{"services/api/**", "services/api/internal/db/db.go", true},
+		{"services/api/**", "services/web/main.go", false},
+		{"services/*/main.go", "services/api/main.go", true},
+		{"services/*/main.go", "services/api/cmd/main.go", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/intro.md", true},
+		{"*.md", "docs/intro.md", false},
+		{"/docker-compose.yml", "docker-compose.yml", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file10.txt", false},
+		{"a+b.txt", "a+b.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.file, func(t *testing.T) {
+			assert.Equal(t, tt.want, globToRegexp(tt.pattern).MatchString(tt.file))
+		})
+	}
+}
+
+func TestTargetMatches(t *testing.T) {
+	api := Target{
+		Paths:       []string{"services/api/**"},
+		IgnorePaths: []string{"**/*.md"},
+	}
+	assert.True(t, api.Matches([]string{"README.md", "services/api/main.go"}))
+	assert.False(t, api.Matches([]string{"README.md", "services/web/main.go"}))
+	assert.False(t, api.Matches([]string{"services/api/README.md"}))
+
+	all := Target{IgnorePaths: []string{"docs/**"}}
+	assert.True(t, all.Matches([]string{"main.go"}))
+	assert.False(t, all.Matches([]string{"docs/index.md"}))
+	assert.False(t, all.Matches(nil))
+}
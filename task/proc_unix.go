@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package task
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// isolate starts the command in a process group of its own so it can be killed
+// along with anything it starts, such as the commands run by a shell
+func isolate(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// kill kills the command's whole process group
+func kill(c *exec.Cmd) error {
+	return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package task
+
+import "os/exec"
+
+// isolate does nothing, there are no process groups to kill on windows
+func isolate(c *exec.Cmd) {}
+
+// kill kills the command's process
+func kill(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
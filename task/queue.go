@@ -0,0 +1,132 @@
+package task
+
+import "sync"
+
+// Queue is a bounded queue of execution tasks that never blocks the producer.
+// A task replaces any pending task for the same target and action, since only
+// the most recent one is worth executing. When the queue is full, the oldest
+// pending task that isn't a shutdown is dropped to make room, shutdowns are
+// never dropped since they're the only record of a target to stop.
+type Queue struct {
+	limit  int
+	tasks  []ExecutionTask
+	closed bool
+	ready  chan struct{}
+	mu     sync.Mutex
+}
+
+// NewQueue creates a queue that holds at most limit pending tasks
+func NewQueue(limit int) *Queue {
+	return &Queue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Push adds a task to the back of the queue, or takes the place of the pending
+// task it replaces. It returns the task that had to be dropped to make room, if
+// any, which is the pushed task itself when only shutdowns are pending. Tasks
+// pushed after the queue is closed are dropped.
+func (q *Queue) Push(t ExecutionTask) (dropped *ExecutionTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return &t
+	}
+
+	for i, p := range q.tasks {
+		if p.Target.Name == t.Target.Name && p.Shutdown == t.Shutdown {
+			// the task only keeps its place if that doesn't reorder it with
+			// the target's other action
+			if !q.pending(t.Target.Name, i+1) {
+				q.tasks[i] = t
+				q.signal()
+				return nil
+			}
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			break
+		}
+	}
+	if len(q.tasks) >= q.limit {
+		i := q.oldest()
+		if i < 0 && !t.Shutdown {
+			return &t
+		}
+		if i >= 0 {
+			oldest := q.tasks[i]
+			dropped = &oldest
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+		}
+	}
+	q.tasks = append(q.tasks, t)
+	q.signal()
+	return
+}
+
+// pending reports whether there's a task for the target from position i onwards
+func (q *Queue) pending(name string, i int) bool {
+	for _, p := range q.tasks[i:] {
+		if p.Target.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// oldest returns the position of the oldest task that isn't a shutdown, or -1
+func (q *Queue) oldest() int {
+	for i, p := range q.tasks {
+		if !p.Shutdown {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close stops the queue from accepting tasks, the tasks that are already
+// pending can still be consumed.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of pending tasks
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// Next removes the oldest pending task from the queue, blocking until there is
+// one. It returns false once the queue is closed and empty. Only one goroutine
+// should consume a queue.
+func (q *Queue) Next() (ExecutionTask, bool) {
+	for {
+		t, ok, closed := q.pop()
+		if ok || closed {
+			return t, ok
+		}
+		<-q.ready
+	}
+}
+
+func (q *Queue) pop() (t ExecutionTask, ok bool, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tasks) == 0 {
+		return t, false, q.closed
+	}
+	t = q.tasks[0]
+	q.tasks = q.tasks[1:]
+	return t, true, q.closed
+}
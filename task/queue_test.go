@@ -0,0 +1,118 @@
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueCoalesce(t *testing.T) {
+	q := NewQueue(10)
+	q.Push(ExecutionTask{Target: Target{Name: "a"}, Path: "1"})
+	q.Push(ExecutionTask{Target: Target{Name: "b"}, Path: "1"})
+	q.Push(ExecutionTask{Target: Target{Name: "a"}, Shutdown: true, Path: "1"})
+	q.Push(ExecutionTask{Target: Target{Name: "a"}, Path: "2"})
+	assert.Equal(t, 3, q.Len())
+
+	// the newer task for a replaces the older one and moves behind the shutdown
+	assert.Equal(t, ExecutionTask{Target: Target{Name: "b"}, Path: "1"}, next(t, q))
+	assert.Equal(t, ExecutionTask{Target: Target{Name: "a"}, Shutdown: true, Path: "1"}, next(t, q))
+	assert.Equal(t, ExecutionTask{Target: Target{Name: "a"}, Path: "2"}, next(t, q))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestQueueReplaceKeepsPlace(t *testing.T) {
+	q := NewQueue(10)
+	q.Push(ExecutionTask{Target: Target{Name: "a"}, Path: "1"})
+	q.Push(ExecutionTask{Target: Target{Name: "b"}, Path: "1"})
+	q.Push(ExecutionTask{Target: Target{Name: "a"}, Path: "2"})
+	assert.Equal(t, 2, q.Len())
+
+	assert.Equal(t, ExecutionTask{Target: Target{Name: "a"}, Path: "2"}, next(t, q))
+	assert.Equal(t, ExecutionTask{Target: Target{Name: "b"}, Path: "1"}, next(t, q))
+}
+
+func TestQueueDropsOldest(t *testing.T) {
+	q := NewQueue(2)
+	assert.Nil(t, q.Push(ExecutionTask{Target: Target{Name: "a"}}))
+	assert.Nil(t, q.Push(ExecutionTask{Target: Target{Name: "b"}}))
+
+	dropped := q.Push(ExecutionTask{Target: Target{Name: "c"}})
+	if assert.NotNil(t, dropped) {
+		assert.Equal(t, "a", dropped.Target.Name)
+	}
+	assert.Equal(t, "b", next(t, q).Target.Name)
+	assert.Equal(t, "c", next(t, q).Target.Name)
+}
+
+func TestQueueKeepsShutdowns(t *testing.T) {
+	q := NewQueue(2)
+	assert.Nil(t, q.Push(ExecutionTask{Target: Target{Name: "a"}, Shutdown: true}))
+	assert.Nil(t, q.Push(ExecutionTask{Target: Target{Name: "b"}}))
+
+	// the oldest task that isn't a shutdown is dropped instead
+	dropped := q.Push(ExecutionTask{Target: Target{Name: "c"}})
+	if assert.NotNil(t, dropped) {
+		assert.Equal(t, "b", dropped.Target.Name)
+	}
+
+	dropped = q.Push(ExecutionTask{Target: Target{Name: "d"}, Shutdown: true})
+	if assert.NotNil(t, dropped) {
+		assert.Equal(t, "c", dropped.Target.Name)
+	}
+
+	// once only shutdowns are pending, other tasks are turned away but more
+	// shutdowns are still accepted
+	dropped = q.Push(ExecutionTask{Target: Target{Name: "e"}})
+	if assert.NotNil(t, dropped) {
+		assert.Equal(t, "e", dropped.Target.Name)
+	}
+	assert.Nil(t, q.Push(ExecutionTask{Target: Target{Name: "f"}, Shutdown: true}))
+	assert.Equal(t, 3, q.Len())
+
+	assert.Equal(t, "a", next(t, q).Target.Name)
+	assert.Equal(t, "d", next(t, q).Target.Name)
+	assert.Equal(t, "f", next(t, q).Target.Name)
+}
+
+func TestQueueClose(t *testing.T) {
+	q := NewQueue(2)
+	q.Push(ExecutionTask{Target: Target{Name: "a"}})
+	q.Close()
+
+	assert.NotNil(t, q.Push(ExecutionTask{Target: Target{Name: "b"}}))
+	assert.Equal(t, "a", next(t, q).Target.Name)
+
+	_, ok := q.Next()
+	assert.False(t, ok)
+}
+
+func TestQueueNextBlocks(t *testing.T) {
+	q := NewQueue(2)
+	results := make(chan ExecutionTask)
+	go func() {
+		task, _ := q.Next()
+		results <- task
+	}()
+
+	select {
+	case <-results:
+		t.Fatal("Next returned before a task was pushed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Push(ExecutionTask{Target: Target{Name: "a"}})
+	select {
+	case got := <-results:
+		assert.Equal(t, "a", got.Target.Name)
+	case <-time.After(time.Second):
+		t.Fatal("Next did not return after a task was pushed")
+	}
+}
+
+func next(t *testing.T, q *Queue) ExecutionTask {
+	task, ok := q.Next()
+	assert.True(t, ok)
+	return task
+}
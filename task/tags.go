@@ -0,0 +1,57 @@
+package task
+
+import (
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
+)
+
+// TracksTags reports whether the target follows tags instead of a branch.
+func (t *Target) TracksTags() bool {
+	return t.Ref == "" && (t.Tag != "" || t.Semver != "")
+}
+
+// FollowsBranch reports whether the target follows new commits on a branch, as
+// opposed to following tags or being pinned to a ref.
+func (t *Target) FollowsBranch() bool {
+	return t.Ref == "" && !t.TracksTags()
+}
+
+// SelectTag picks the highest of the given tag names that satisfies the
+// target's `Tag` glob and `Semver` constraint. Tags that parse as semantic
+// versions are ordered by version, any others are ordered lexically below them.
+func (t *Target) SelectTag(tags []string) (selected string, err error) {
+	var constraint *semver.Constraints
+	if t.Semver != "" {
+		constraint, err = semver.NewConstraint(t.Semver)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid semver constraint '%s'", t.Semver)
+		}
+	}
+
+	var best *semver.Version
+	for _, tag := range tags {
+		if t.Tag != "" {
+			if ok, _ := path.Match(t.Tag, tag); !ok {
+				continue
+			}
+		}
+
+		version, verr := semver.NewVersion(tag)
+		if constraint != nil && (verr != nil || !constraint.Check(version)) {
+			continue
+		}
+
+		switch {
+		case verr == nil && (best == nil || version.GreaterThan(best)):
+			best = version
+			selected = tag
+		case verr != nil && best == nil && strings.Compare(tag, selected) > 0:
+			selected = tag
+		}
+	}
+
+	return selected, nil
+}
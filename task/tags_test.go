@@ -0,0 +1,42 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetSelectTag(t *testing.T) {
+	tags := []string{"v1.0.0", "v1.2.0", "v1.10.1", "v2.3.0", "v2.3.4", "v2.4.0", "v3.0.0-rc1", "latest"}
+
+	tests := []struct {
+		name   string
+		target Target
+		want   string
+	}{
+		{"glob", Target{Tag: "v1.*"}, "v1.10.1"},
+		{"semver caret", Target{Semver: "^2.3"}, "v2.4.0"},
+		{"semver tilde", Target{Semver: "~2.3"}, "v2.3.4"},
+		{"glob and semver", Target{Tag: "v2.3.*", Semver: ">=2.0"}, "v2.3.4"},
+		{"non-semver", Target{Tag: "lat*"}, "latest"},
+		{"no match", Target{Semver: "^4"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.target.SelectTag(tags)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := (&Target{Semver: "not a constraint"}).SelectTag(tags)
+	assert.Error(t, err)
+}
+
+func TestTargetFollowsBranch(t *testing.T) {
+	assert.True(t, (&Target{Branch: "master"}).FollowsBranch())
+	assert.False(t, (&Target{Tag: "v*"}).FollowsBranch())
+	assert.False(t, (&Target{Semver: "^1"}).FollowsBranch())
+	assert.False(t, (&Target{Ref: "v1.0.0"}).FollowsBranch())
+	assert.False(t, (&Target{Ref: "v1.0.0", Tag: "v*"}).TracksTags())
+}
@@ -2,8 +2,11 @@ package task
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -16,6 +19,23 @@ type ExecutionTask struct {
 	Env      map[string]string
 }
 
+// Triggers describe why an execution task was dispatched, they are passed to
+// commands via the PICO_TRIGGER environment variable.
+const (
+	TriggerConfig   = "config"   // the target was added or changed in the config
+	TriggerCommit   = "commit"   // the target's repository received a new commit
+	TriggerRemove   = "remove"   // the target was removed from the config
+	TriggerShutdown = "shutdown" // pico is shutting down gracefully
+	TriggerManual   = "manual"   // the target was run on request
+)
+
+// Behaviours for when a target's definition changes in the config.
+const (
+	OnChangeUp      = "up"      // run the new `up` only, the default
+	OnChangeRestart = "restart" // run the old `down` then the new `up`
+	OnChangeSource  = "source"  // restart only if the repository or ref changed
+)
+
 // Repo represents a Git repo with credentials
 type Repo struct {
 	URL  string
@@ -38,25 +58,142 @@ type Target struct {
 	// The git branch to use
 	Branch string `json:"branch"`
 
+	// Follow the highest tag matching this glob instead of a branch
+	Tag string `json:"tag"`
+
+	// Follow the highest tag satisfying this semver constraint instead of a branch
+	Semver string `json:"semver"`
+
+	// Pin the target to a tag or full commit SHA and stop following new commits
+	Ref string `json:"ref"`
+
+	// How often to check the repository for changes, overrides the global interval
+	CheckInterval Duration `json:"check_interval"`
+
 	// The command to run on each new Git commit
 	Up []string `required:"true" json:"up"`
 
+	// A shell string to run on each new Git commit instead of `Up`
+	Run string `json:"run"`
+
+	// The shell used to interpret `Run` strings, defaults to `sh`
+	Shell string `json:"shell"`
+
+	// An ordered list of steps to run on each new Git commit instead of `Up`
+	Steps []Step `json:"steps"`
+
+	// Only run when a commit changes files matching one of these globs
+	Paths []string `json:"paths"`
+
+	// Ignore changes to files matching any of these globs
+	IgnorePaths []string `json:"ignore_paths"`
+
 	// Down specifies the command to run during either a graceful shutdown or when the target is removed
 	Down []string `json:"down"`
 
+	// A shell string to run instead of `Down`, interpreted by `Shell`
+	DownRun string `json:"down_run"`
+
+	// An optional check to verify the target is working after each deployment
+	HealthCheck *HealthCheck `json:"healthcheck"`
+
 	// Environment variables associated with the target - do not store credentials here!
 	Env map[string]string `json:"env"`
 
-	// Whether or not to run `Command` on first run, useful if the command is `docker-compose up`
-	InitialRun bool `json:"initial_run"`
+	// Whether or not to run `Up` when the target is first seen, useful if the
+	// command is `docker-compose up`. Defaults to true, when false the target
+	// only runs on subsequent commits.
+	InitialRun *bool `json:"initial_run"`
 
 	// Auth method to use from the auth store
 	Auth string `json:"auth"`
+
+	// Names of targets that must be started before this one and stopped after
+	// it. If one fails to start, this target is skipped until it succeeds.
+	DependsOn []string `json:"depends_on"`
+
+	// What to do when the target's definition changes, one of the OnChange*
+	// constants. Defaults to running `Up` only.
+	OnChange string `json:"on_change"`
+
+	// The forge to report the outcome of each deployment to as a commit status,
+	// one of "github", "gitlab" or "gitea". Uses the target's auth method.
+	CommitStatus string `json:"commit_status"`
+}
+
+// DefaultShell is used to interpret `Run` strings when no shell is specified.
+const DefaultShell = "sh"
+
+// Step represents a single named command within a target's pipeline.
+type Step struct {
+	// A label for the step, used in logs and status reports
+	Name string `required:"true" json:"name"`
+
+	// The command to run for this step
+	Command []string `required:"true" json:"command"`
+
+	// A shell string to run for this step instead of `Command`
+	Run string `json:"run"`
+
+	// The shell used to interpret `Run`, defaults to the target's shell
+	Shell string `json:"shell"`
+
+	// Environment variables that override the target's environment for this step
+	Env map[string]string `json:"env"`
+
+	// Working directory, relative to the target's repository directory
+	Dir string `json:"dir"`
+
+	// How long the step may run for before it's killed, zero means no limit
+	Timeout Duration `json:"timeout"`
+
+	// Whether or not to carry on with the remaining steps if this one fails
+	ContinueOnError bool `json:"continue_on_error"`
+}
+
+// StepResult describes the outcome of running a single step.
+type StepResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// RunsInitially reports whether the target should be run when it's first seen
+func (t *Target) RunsInitially() bool {
+	return t.InitialRun == nil || *t.InitialRun
+}
+
+// HasDown reports whether the target has a `down` command to stop it with
+func (t *Target) HasDown() bool {
+	return len(t.Down) > 0 || t.DownRun != ""
+}
+
+// Pipeline returns the ordered list of steps to run for the target. Targets
+// that only declare `Up` and `Down` commands are treated as single-step
+// pipelines so the executor can handle both forms the same way.
+func (t *Target) Pipeline(shutdown bool) []Step {
+	if shutdown {
+		return []Step{{Name: "down", Command: t.Down, Run: t.DownRun, Shell: t.Shell}}
+	}
+	if len(t.Steps) > 0 {
+		steps := make([]Step, len(t.Steps))
+		for i, s := range t.Steps {
+			if s.Shell == "" {
+				s.Shell = t.Shell
+			}
+			steps[i] = s
+		}
+		return steps
+	}
+	return []Step{{Name: "up", Command: t.Up, Run: t.Run, Shell: t.Shell}}
 }
 
-// Execute runs the target's command in the specified directory with the
-// specified environment variables
-func (t *Target) Execute(dir string, env map[string]string, shutdown bool, inheritEnv bool) (err error) {
+// Execute runs the target's pipeline in the specified directory with the
+// specified environment variables. The result of each step that was attempted
+// is returned, the pipeline halts at the first failing step unless that step
+// is marked with `ContinueOnError`. The output of each step is written to out,
+// or to stdout if out is nil.
+func (t *Target) Execute(dir string, env map[string]string, shutdown bool, inheritEnv bool, out io.Writer) (results []StepResult, err error) {
 	if env == nil {
 		env = make(map[string]string)
 	}
@@ -64,22 +201,110 @@ func (t *Target) Execute(dir string, env map[string]string, shutdown bool, inher
 		env[k] = v
 	}
 
-	var command []string
-	if shutdown {
-		command = t.Down
-	} else {
-		command = t.Up
+	for _, s := range t.Pipeline(shutdown) {
+		result := s.execute(dir, env, inheritEnv, out)
+		results = append(results, result)
+		if result.Err != nil && !s.ContinueOnError {
+			return results, errors.Wrapf(result.Err, "step '%s' failed", s.Name)
+		}
+	}
+
+	return results, nil
+}
+
+// CheckHealth runs the target's health check if it has one. Command checks are
+// run in the specified directory with the same environment as the pipeline.
+func (t *Target) CheckHealth(dir string, env map[string]string, inheritEnv bool, out io.Writer) error {
+	if t.HealthCheck == nil {
+		return nil
+	}
+	checkEnv := make(map[string]string)
+	for k, v := range env {
+		checkEnv[k] = v
+	}
+	for k, v := range t.Env {
+		checkEnv[k] = v
+	}
+	return t.HealthCheck.Check(dir, t.Shell, checkEnv, inheritEnv, out)
+}
+
+func (s Step) execute(dir string, env map[string]string, inheritEnv bool, out io.Writer) (result StepResult) {
+	result.Name = s.Name
+
+	stepEnv := make(map[string]string)
+	for k, v := range env {
+		stepEnv[k] = v
+	}
+	for k, v := range s.Env {
+		stepEnv[k] = v
 	}
 
-	c, err := prepare(dir, env, command, inheritEnv)
+	c, err := prepare(filepath.Join(dir, s.Dir), stepEnv, s.command(), inheritEnv, out)
 	if err != nil {
-		return errors.Wrap(err, "failed to prepare command for execution")
+		result.Err = errors.Wrap(err, "failed to prepare command for execution")
+		return
 	}
 
-	return c.Run()
+	start := time.Now()
+	result.Err = run(c, time.Duration(s.Timeout))
+	result.Duration = time.Since(start)
+
+	return
+}
+
+// command returns the argv for the step, wrapping `Run` in an invocation of the
+// step's shell if the step was declared as a shell string.
+func (s Step) command() []string {
+	if s.Run == "" {
+		return s.Command
+	}
+	shell := s.Shell
+	if shell == "" {
+		shell = DefaultShell
+	}
+	return []string{shell, "-c", s.Run}
+}
+
+// waitDelay is how long to wait for a killed command's output to be closed by
+// any processes that escaped its process group before giving up on them
+const waitDelay = 2 * time.Second
+
+// run starts the command and waits for it to finish, killing it and everything
+// it started if it runs for longer than the timeout. A zero timeout waits
+// indefinitely.
+func run(c *exec.Cmd, timeout time.Duration) error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- wait(c) }()
+
+	if timeout == 0 {
+		return <-done
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		kill(c) //nolint:errcheck
+		<-done
+		return errors.Errorf("timed out after %s", timeout)
+	}
 }
 
-func prepare(dir string, env map[string]string, command []string, inheritEnv bool) (cmd *exec.Cmd, err error) {
+// wait waits for the command to exit. A command that succeeded is successful
+// even if something it left running in the background still holds its output.
+func wait(c *exec.Cmd) error {
+	err := c.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return nil
+	}
+	return err
+}
+
+func prepare(dir string, env map[string]string, command []string, inheritEnv bool, out io.Writer) (cmd *exec.Cmd, err error) {
 	if len(command) == 0 {
 		return nil, errors.New("attempt to execute target with empty command")
 	}
@@ -89,8 +314,13 @@ func prepare(dir string, env map[string]string, command []string, inheritEnv boo
 		cmd.Args = append(cmd.Args, command[1:]...)
 	}
 	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+	if out == nil {
+		out = os.Stdout
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.WaitDelay = waitDelay
+	isolate(cmd)
 
 	var cmdEnv []string
 	if inheritEnv {
@@ -1,8 +1,10 @@
 package task
 
 import (
+	"bytes"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -13,7 +15,7 @@ func TestPrepareTargetExecution(t *testing.T) {
 		"VAR_2": "two",
 		"VAR_3": "three",
 		"VAR_4": "four",
-	}, []string{"docker-compose", "up", "-d"}, false)
+	}, []string{"docker-compose", "up", "-d"}, false, nil)
 	assert.NoError(t, err)
 
 	assert.Equal(t, []string{"docker-compose", "up", "-d"}, c.Args)
@@ -29,3 +31,109 @@ func TestPrepareTargetExecution(t *testing.T) {
 	assert.Equal(t, want, got)
 	assert.Equal(t, ".", c.Dir)
 }
+
+func TestTargetExecutePipeline(t *testing.T) {
+	target := Target{
+		Steps: []Step{
+			{Name: "one", Command: []string{"true"}},
+			{Name: "two", Command: []string{"false"}, ContinueOnError: true},
+			{Name: "three", Command: []string{"false"}},
+			{Name: "four", Command: []string{"true"}},
+		},
+	}
+
+	results, err := target.Execute(".", nil, false, false, nil)
+	assert.Error(t, err)
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[0].Err)
+	assert.Error(t, results[1].Err)
+	assert.Error(t, results[2].Err)
+	assert.Equal(t, "three", results[2].Name)
+}
+
+func TestTargetExecuteStepTimeout(t *testing.T) {
+	target := Target{
+		Steps: []Step{
+			{Name: "slow", Command: []string{"sleep", "5"}, Timeout: Duration(100 * time.Millisecond)},
+		},
+	}
+
+	results, err := target.Execute(".", nil, false, false, nil)
+	assert.Error(t, err)
+	assert.Len(t, results, 1)
+	assert.True(t, results[0].Duration < time.Second)
+}
+
+func TestTargetExecuteStepTimeoutKillsChildren(t *testing.T) {
+	// the shell's children hold the output open, so they must be killed too
+	target := Target{
+		Steps: []Step{
+			{Name: "slow", Run: "sleep 5; echo done", Timeout: Duration(100 * time.Millisecond)},
+		},
+	}
+
+	out := &bytes.Buffer{}
+	results, err := target.Execute(".", nil, false, false, out)
+	assert.Error(t, err)
+	assert.Len(t, results, 1)
+	assert.Contains(t, results[0].Err.Error(), "timed out")
+	assert.True(t, results[0].Duration < time.Second)
+	assert.NotContains(t, out.String(), "done")
+}
+
+func TestTargetExecuteBackgroundProcess(t *testing.T) {
+	// a process left running in the background keeps the output open, but the
+	// step has still succeeded
+	target := Target{
+		Steps: []Step{
+			{Name: "detach", Run: "sleep 5 & echo started"},
+		},
+	}
+
+	out := &bytes.Buffer{}
+	results, err := target.Execute(".", nil, false, false, out)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.True(t, results[0].Duration < 4*time.Second)
+	assert.Contains(t, out.String(), "started")
+}
+
+func TestTargetPipeline(t *testing.T) {
+	target := Target{
+		Up:   []string{"docker-compose", "up", "-d"},
+		Down: []string{"docker-compose", "down"},
+	}
+
+	assert.Equal(t, []Step{{Name: "up", Command: []string{"docker-compose", "up", "-d"}}}, target.Pipeline(false))
+	assert.Equal(t, []Step{{Name: "down", Command: []string{"docker-compose", "down"}}}, target.Pipeline(true))
+	assert.True(t, target.HasDown())
+
+	target = Target{Run: "docker-compose up -d", DownRun: "docker-compose down", Shell: "bash"}
+	assert.Equal(t, []string{"bash", "-c", "docker-compose down"}, target.Pipeline(true)[0].command())
+	assert.True(t, target.HasDown())
+	assert.False(t, (&Target{Up: []string{"true"}}).HasDown())
+}
+
+func TestStepCommand(t *testing.T) {
+	assert.Equal(t, []string{"docker-compose", "up", "-d"}, Step{Command: []string{"docker-compose", "up", "-d"}}.command())
+	assert.Equal(t, []string{"sh", "-c", "git pull && make"}, Step{Run: "git pull && make"}.command())
+	assert.Equal(t, []string{"bash", "-c", "git pull && make"}, Step{Run: "git pull && make", Shell: "bash"}.command())
+
+	target := Target{
+		Shell: "bash",
+		Steps: []Step{
+			{Name: "one", Run: "echo one"},
+			{Name: "two", Run: "echo two", Shell: "zsh"},
+		},
+	}
+	pipeline := target.Pipeline(false)
+	assert.Equal(t, []string{"bash", "-c", "echo one"}, pipeline[0].command())
+	assert.Equal(t, []string{"zsh", "-c", "echo two"}, pipeline[1].command())
+}
+
+func TestTargetRunsInitially(t *testing.T) {
+	yes, no := true, false
+	assert.True(t, (&Target{}).RunsInitially())
+	assert.True(t, (&Target{InitialRun: &yes}).RunsInitially())
+	assert.False(t, (&Target{InitialRun: &no}).RunsInitially())
+}
@@ -0,0 +1,166 @@
+// Package tracing records spans for the work the daemon does, from evaluating
+// the config through to executing each target, and exports them to an
+// OpenTelemetry collector over OTLP/HTTP. The trace context is carried between
+// components in a context or a W3C `traceparent` string, which is also passed
+// to target commands in the TRACEPARENT environment variable so they can add
+// their own spans to the trace.
+//
+// It's a thin layer over the OpenTelemetry SDK that keeps the rest of pico
+// unaware of it and does nothing until tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// EnvVar is the environment variable the trace context is passed to commands in
+const EnvVar = "TRACEPARENT"
+
+const (
+	traceparentKey  = "traceparent"
+	instrumentation = "github.com/picostack/pico"
+)
+
+var propagator = propagation.TraceContext{}
+
+// Span is a single timed operation in a trace. A nil span is valid and does
+// nothing, it's what Start returns while tracing is disabled.
+type Span struct {
+	span trace.Span
+}
+
+// Start starts a span as a child of the span in the context, or as the root of a
+// new trace if there isn't one. The returned context contains the new span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	p := current()
+	if p == nil {
+		return ctx, nil
+	}
+	ctx, s := p.Tracer(instrumentation).Start(ctx, name)
+	return ctx, &Span{s}
+}
+
+// WithTraceparent returns a context that spans started from will be children of
+// the span described by the W3C traceparent. Invalid traceparents are ignored.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{traceparentKey: traceparent})
+}
+
+// Traceparent returns the W3C traceparent of the span in the context, or an
+// empty string if there isn't one.
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier[traceparentKey]
+}
+
+// Traceparent returns the span's W3C traceparent
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return Traceparent(trace.ContextWithSpan(context.Background(), s.span))
+}
+
+// SetAttribute records a detail of the operation
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// SetError marks the operation as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+var (
+	stdMu sync.Mutex
+	std   *sdktrace.TracerProvider
+)
+
+// Enable starts exporting spans to the collector at the endpoint, such as
+// http://localhost:4318, identifying them as coming from the host. Tracing is
+// disabled until it's called.
+func Enable(endpoint, hostname string) error {
+	// like OTEL_EXPORTER_OTLP_ENDPOINT, the endpoint is the collector's base URL
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(url))
+	if err != nil {
+		return errors.Wrap(err, "failed to create OTLP exporter")
+	}
+	enable(exporter, hostname)
+	return nil
+}
+
+func enable(exporter sdktrace.SpanExporter, hostname string) {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("pico"),
+			semconv.HostName(hostname),
+		)),
+	)
+
+	stdMu.Lock()
+	previous := std
+	std = provider
+	stdMu.Unlock()
+	shutdown(previous)
+}
+
+// Shutdown exports every span that has ended and disables tracing
+func Shutdown() {
+	stdMu.Lock()
+	p := std
+	std = nil
+	stdMu.Unlock()
+	shutdown(p)
+}
+
+func shutdown(p *sdktrace.TracerProvider) {
+	if p == nil {
+		return
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		zap.L().Warn("failed to export spans", zap.Error(err))
+	}
+}
+
+func current() *sdktrace.TracerProvider {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	return std
+}
@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop")
+	assert.Nil(t, span)
+	assert.Equal(t, "", Traceparent(ctx))
+
+	// a nil span is safe to use
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+}
+
+func TestWithTraceparent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	enable(exporter, "host")
+	defer Shutdown()
+
+	for _, invalid := range []string{
+		"",
+		"garbage",
+		"00-0af7651916cd43dd-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+	} {
+		_, span := Start(WithTraceparent(context.Background(), invalid), "invalid")
+		assert.NotEqual(t, "0af7651916cd43dd8448eb211c80319c", span.span.SpanContext().TraceID().String(), invalid)
+		span.End()
+	}
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	_, span := Start(WithTraceparent(context.Background(), parent), "valid")
+	assert.Regexp(t, "^00-0af7651916cd43dd8448eb211c80319c-[0-9a-f]{16}-01$", span.Traceparent())
+	assert.NotEqual(t, parent, span.Traceparent())
+	span.End()
+}
+
+// kept holds on to the exported spans when tracing is shut down
+type kept struct {
+	*tracetest.InMemoryExporter
+}
+
+func (kept) Shutdown(context.Context) error { return nil }
+
+func TestSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	enable(kept{exporter}, "host")
+
+	ctx, root := Start(context.Background(), "reconfigure")
+	root.SetAttribute("commit", "abc123")
+	_, child := Start(ctx, "config.evaluate")
+	child.SetError(errors.New("syntax error"))
+	child.End()
+
+	// a span in another component, which only has the traceparent
+	remote := WithTraceparent(context.Background(), root.Traceparent())
+	_, execute := Start(remote, "execute")
+	execute.End()
+	root.End()
+
+	Shutdown()
+
+	// disabled again after shutting down
+	_, after := Start(context.Background(), "after")
+	assert.Nil(t, after)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	evaluate, exec, reconfigure := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "reconfigure", reconfigure.Name)
+	assert.False(t, reconfigure.Parent.IsValid())
+	assert.Equal(t, []attribute.KeyValue{attribute.String("commit", "abc123")}, reconfigure.Attributes)
+	assert.Contains(t, reconfigure.Resource.Attributes(), attribute.String("service.name", "pico"))
+	assert.Contains(t, reconfigure.Resource.Attributes(), attribute.String("host.name", "host"))
+
+	for _, s := range []tracetest.SpanStub{evaluate, exec} {
+		assert.Equal(t, reconfigure.SpanContext.TraceID(), s.SpanContext.TraceID())
+		assert.Equal(t, reconfigure.SpanContext.SpanID(), s.Parent.SpanID())
+	}
+	assert.Equal(t, "config.evaluate", evaluate.Name)
+	assert.Equal(t, codes.Error, evaluate.Status.Code)
+	assert.Equal(t, "syntax error", evaluate.Status.Description)
+	assert.Equal(t, "execute", exec.Name)
+}
+
+func TestExport(t *testing.T) {
+	var mu sync.Mutex
+	names := []string{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req coltracepb.ExportTraceServiceRequest
+		assert.NoError(t, proto.Unmarshal(b, &req))
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					names = append(names, s.Name)
+				}
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	require.NoError(t, Enable(collector.URL, "host"))
+	_, span := Start(context.Background(), "reconfigure")
+	span.End()
+	Shutdown()
+
+	assert.Equal(t, []string{"reconfigure"}, names)
+}
@@ -0,0 +1,95 @@
+// Package watchdog keeps track of the daemon's waitpoints, the places where it
+// blocks on another part of the system, and reports any that have been blocked
+// for suspiciously long so a frozen host doesn't go unnoticed.
+package watchdog
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Waitpoint describes a goroutine that is currently blocked at a waitpoint
+type Waitpoint struct {
+	Name  string
+	Since time.Time
+}
+
+// Watchdog records the waitpoints that are currently blocked
+type Watchdog struct {
+	active map[int64]Waitpoint
+	next   int64
+	mu     sync.Mutex
+}
+
+// New creates an empty watchdog
+func New() *Watchdog {
+	return &Watchdog{active: make(map[int64]Waitpoint)}
+}
+
+// Enter records that the caller is blocking at the named waitpoint. The
+// returned function must be called once it has stopped blocking.
+func (d *Watchdog) Enter(name string) (leave func()) {
+	d.mu.Lock()
+	id := d.next
+	d.next++
+	d.active[id] = Waitpoint{Name: name, Since: time.Now()}
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		delete(d.active, id)
+		d.mu.Unlock()
+	}
+}
+
+// Stuck returns the waitpoints that have been blocked for longer than the
+// threshold, longest first.
+func (d *Watchdog) Stuck(threshold time.Duration) (stuck []Waitpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for _, w := range d.active {
+		if now.Sub(w.Since) > threshold {
+			stuck = append(stuck, w)
+		}
+	}
+	sort.Slice(stuck, func(i, j int) bool {
+		return stuck[i].Since.Before(stuck[j].Since)
+	})
+	return
+}
+
+// Run checks for stuck waitpoints at every threshold interval and logs a
+// warning for each one until the context is cancelled.
+func (d *Watchdog) Run(ctx context.Context, threshold time.Duration) {
+	t := time.NewTicker(threshold)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, w := range d.Stuck(threshold) {
+				zap.L().Warn("waitpoint appears to be stuck",
+					zap.String("waitpoint", w.Name),
+					zap.Duration("blocked_for", time.Since(w.Since)))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var std = New()
+
+// Enter records a waitpoint on the default watchdog
+func Enter(name string) (leave func()) { return std.Enter(name) }
+
+// Stuck returns the stuck waitpoints of the default watchdog
+func Stuck(threshold time.Duration) []Waitpoint { return std.Stuck(threshold) }
+
+// Run runs the default watchdog
+func Run(ctx context.Context, threshold time.Duration) { std.Run(ctx, threshold) }
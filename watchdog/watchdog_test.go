@@ -0,0 +1,32 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchdog(t *testing.T) {
+	d := New()
+	leaveA := d.Enter("a")
+	time.Sleep(20 * time.Millisecond)
+	leaveB := d.Enter("b")
+
+	assert.Empty(t, d.Stuck(time.Hour))
+
+	stuck := d.Stuck(10 * time.Millisecond)
+	if assert.Len(t, stuck, 1) {
+		assert.Equal(t, "a", stuck[0].Name)
+	}
+
+	stuck = d.Stuck(0)
+	if assert.Len(t, stuck, 2) {
+		assert.Equal(t, "a", stuck[0].Name)
+		assert.Equal(t, "b", stuck[1].Name)
+	}
+
+	leaveA()
+	leaveB()
+	assert.Empty(t, d.Stuck(0))
+}
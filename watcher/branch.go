@@ -0,0 +1,155 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// BranchSession keeps a clone of a repository's branch up to date. It mirrors
+// the shape of a gitwatch.Session for a single repository, but the repository
+// can also be pulled on demand, such as when a webhook arrives. Every pull is
+// serialised with the periodic checks so two never touch the working tree at
+// the same time.
+type BranchSession struct {
+	Events chan gitwatch.Event
+	Errors chan error
+
+	url      string
+	branch   string
+	path     string
+	auth     transport.AuthMethod
+	interval time.Duration
+	jitter   time.Duration
+	session  *gitwatch.Session
+	mu       sync.Mutex // held while the repository is cloned or pulled
+
+	ctx context.Context
+	cf  context.CancelFunc
+}
+
+// NewBranchSession creates a session that keeps the branch of the repository
+// checked out at the path. An empty branch follows the remote's default branch.
+// The repository is pulled at the interval plus a random jitter of up to the
+// given maximum, picked afresh for each pull.
+func NewBranchSession(
+	ctx context.Context,
+	url string,
+	branch string,
+	path string,
+	auth transport.AuthMethod,
+	interval time.Duration,
+	jitter time.Duration,
+) (*BranchSession, error) {
+	ctx2, cf := context.WithCancel(ctx)
+	session, err := gitwatch.New(ctx2, nil, interval, path, auth, false)
+	if err != nil {
+		cf()
+		return nil, err
+	}
+	session.UseForce = true
+	return &BranchSession{
+		Events:   make(chan gitwatch.Event, 1),
+		Errors:   make(chan error, 16),
+		url:      url,
+		branch:   branch,
+		path:     path,
+		auth:     auth,
+		interval: interval,
+		jitter:   jitter,
+		session:  session,
+		ctx:      ctx2,
+		cf:       cf,
+	}, nil
+}
+
+// Sync clones the repository if it doesn't exist yet, otherwise it's pulled and
+// an event is emitted if there were any changes.
+func (s *BranchSession) Sync() error {
+	event, err := s.Pull()
+	if err != nil || event == nil {
+		return err
+	}
+	s.emit(*event)
+	return nil
+}
+
+// Run pulls the repository at the session's interval, plus its jitter, and
+// emits an event whenever there are changes. It blocks until the session is
+// closed.
+func (s *BranchSession) Run() {
+	defer close(s.Errors)
+
+	for {
+		if !wait(s.ctx, Jitter(s.interval, s.jitter)) {
+			return
+		}
+
+		event, err := s.Pull()
+		if err != nil {
+			select {
+			case s.Errors <- err:
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+		if event != nil && !s.emit(*event) {
+			return
+		}
+	}
+}
+
+// Pull fetches the branch and checks it out straight away, cloning the
+// repository first if necessary. It returns an event if there were any changes
+// to an existing clone.
+func (s *BranchSession) Pull() (*gitwatch.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer observeFetch(s.url, time.Now())
+
+	repo, err := git.PlainOpen(s.path)
+	if err == git.ErrRepositoryNotExists {
+		return nil, s.clone()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open local repo")
+	}
+	return s.session.GetEventFromRepoChanges(repo, s.branch, s.auth)
+}
+
+// Close stops the session
+func (s *BranchSession) Close() {
+	s.cf()
+}
+
+func (s *BranchSession) clone() error {
+	var ref plumbing.ReferenceName
+	if s.branch != "" {
+		ref = plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", s.branch))
+	}
+	_, err := git.PlainCloneContext(s.ctx, s.path, false, &git.CloneOptions{
+		Auth:              s.auth,
+		URL:               s.url,
+		ReferenceName:     ref,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+	})
+	return errors.Wrap(err, "failed to clone initial copy of repository")
+}
+
+// emit sends the event unless the session is closed first
+func (s *BranchSession) emit(e gitwatch.Event) bool {
+	select {
+	case s.Events <- e:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
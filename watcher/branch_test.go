@@ -0,0 +1,64 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBranchSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-branch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	first := up.commit("one")
+	path := filepath.Join(dir, "clone")
+
+	s, err := NewBranchSession(context.Background(), up.path, "", path, nil, 10*time.Millisecond, 0)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// the first sync only clones the repository
+	require.NoError(t, s.Sync())
+	assert.Equal(t, first, headSHAAt(t, path))
+	assert.Empty(t, s.Events)
+
+	go s.Run()
+	second := up.commit("two")
+
+	// pulls on demand race with the session's own polling, but the change is
+	// only ever picked up once
+	var mu sync.Mutex
+	changes := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			event, err := s.Pull()
+			assert.NoError(t, err)
+			if event != nil {
+				mu.Lock()
+				changes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-s.Events:
+		changes++
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 1, changes)
+	assert.Equal(t, second, headSHAAt(t, path))
+}
@@ -0,0 +1,104 @@
+package watcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitInfo describes the commit checked out in a target's directory and what
+// changed since the previously deployed commit.
+type commitInfo struct {
+	SHA      string
+	Previous string
+	Branch   string
+	Message  string
+	Author   string
+	Files    []string
+}
+
+// getCommitInfo reads the HEAD commit of the repository at path. If previous is
+// set and present in the repository, the files changed between the two commits
+// are also listed.
+func getCommitInfo(path, previous string) (info commitInfo, err error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return info, errors.Wrap(err, "failed to open repository")
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return info, errors.Wrap(err, "failed to read HEAD")
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return info, errors.Wrap(err, "failed to read HEAD commit")
+	}
+
+	info.SHA = commit.Hash.String()
+	info.Previous = previous
+	info.Message = strings.TrimSpace(commit.Message)
+	info.Author = fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email)
+	if head.Name().IsBranch() {
+		info.Branch = head.Name().Short()
+	}
+
+	if previous != "" && previous != info.SHA {
+		info.Files, err = changedFiles(repo, plumbing.NewHash(previous), commit)
+		if err != nil {
+			return info, errors.Wrapf(err, "failed to list changes since %s", previous)
+		}
+	}
+
+	return info, nil
+}
+
+func changedFiles(repo *git.Repository, from plumbing.Hash, to *object.Commit) ([]string, error) {
+	fromCommit, err := repo.CommitObject(from)
+	if err != nil {
+		return nil, err
+	}
+	fromTree, err := fromCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range changes {
+		seen[c.From.Name] = true
+		seen[c.To.Name] = true
+	}
+	delete(seen, "")
+
+	files := make([]string, 0, len(seen))
+	for f := range seen {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// env returns the commit information as the PICO_* environment variables that
+// are passed to a target's commands.
+func (c commitInfo) env() map[string]string {
+	return map[string]string{
+		"PICO_COMMIT_SHA":     c.SHA,
+		"PICO_PREVIOUS_SHA":   c.Previous,
+		"PICO_BRANCH":         c.Branch,
+		"PICO_COMMIT_MESSAGE": c.Message,
+		"PICO_COMMIT_AUTHOR":  c.Author,
+		"PICO_CHANGED_FILES":  strings.Join(c.Files, "\n"),
+	}
+}
@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestGetCommitInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-commit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "Southclaws", Email: "hello@southcla.ws", When: time.Now()}
+
+	commit := func(message string, files ...string) string {
+		for _, f := range files {
+			require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, f)), os.ModePerm))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, f), []byte(message), 0644))
+			_, err = wt.Add(f)
+			require.NoError(t, err)
+		}
+		h, err := wt.Commit(message, &git.CommitOptions{Author: sig})
+		require.NoError(t, err)
+		return h.String()
+	}
+
+	first := commit("initial commit\n", "README.md", "services/api/main.go")
+	second := commit("update api\n", "services/api/main.go", "services/api/go.mod")
+
+	info, err := getCommitInfo(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, commitInfo{
+		SHA:     second,
+		Branch:  "master",
+		Message: "update api",
+		Author:  "Southclaws <hello@southcla.ws>",
+	}, info)
+
+	info, err = getCommitInfo(dir, first)
+	assert.NoError(t, err)
+	assert.Equal(t, first, info.Previous)
+	assert.Equal(t, []string{"services/api/go.mod", "services/api/main.go"}, info.Files)
+	assert.Equal(t, "services/api/go.mod\nservices/api/main.go", info.env()["PICO_CHANGED_FILES"])
+}
@@ -0,0 +1,261 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/tracing"
+)
+
+// pauseFile pauses every target while it exists in the directory the watcher
+// clones repositories into. It's created and removed by PauseAll and ResumeAll
+// but can also be managed by hand, and keeps the host paused across restarts.
+const pauseFile = ".pico-pause"
+
+// pauseFileInterval is how often the pause file is checked for changes made
+// outside of the daemon.
+const pauseFileInterval = time.Second * 5
+
+// heldKey identifies a task held for a paused target, a target can have both a
+// `down` and an `up` held when it's restarted.
+type heldKey struct {
+	name     string
+	shutdown bool
+}
+
+// ErrUnknownTarget is returned when controlling a target that isn't in the
+// current state.
+var ErrUnknownTarget = errors.New("unknown target")
+
+// Commits returns the commit last deployed successfully for each target
+func (w *GitWatcher) Commits() map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	commits := make(map[string]string)
+	for k, v := range w.commits {
+		commits[k] = v
+	}
+	return commits
+}
+
+// LastReconfigure returns when a state was last applied
+func (w *GitWatcher) LastReconfigure() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastReconfigure
+}
+
+// Trigger asks the daemon loop to run the target's `up` again for its current
+// commit.
+func (w *GitWatcher) Trigger(name string) error {
+	if !w.hasTarget(name) {
+		return ErrUnknownTarget
+	}
+	select {
+	case w.runs <- name:
+		return nil
+	default:
+		return errors.New("too many pending run requests")
+	}
+}
+
+func (w *GitWatcher) doRun(name string) {
+	for _, t := range w.state.Targets {
+		if t.Name == name {
+			zap.L().Info("running target on request", zap.String("target", name))
+			ctx, span := tracing.Start(context.Background(), "watcher.run")
+			span.SetAttribute("target", name)
+			w.queueTargetTask(ctx, t, filepath.Join(w.directory, getTargetPath(t)), false, task.TriggerManual)
+			span.End()
+			return
+		}
+	}
+}
+
+// Pause stops tasks for the target from being executed. Its repository is
+// still watched and the latest task is held until it's resumed.
+func (w *GitWatcher) Pause(name string) error {
+	if !w.hasTarget(name) {
+		return ErrUnknownTarget
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused[name] = true
+	zap.L().Info("paused target", zap.String("target", name))
+	return nil
+}
+
+// Resume lets tasks for the target be executed again, the latest task that was
+// held while it was paused is executed straight away unless every target is
+// paused.
+func (w *GitWatcher) Resume(name string) error {
+	w.mu.Lock()
+	if !w.paused[name] {
+		w.mu.Unlock()
+		if !w.hasTarget(name) {
+			return ErrUnknownTarget
+		}
+		return nil
+	}
+	delete(w.paused, name)
+	release := []task.ExecutionTask{}
+	if !w.pausedAll {
+		// the target is shut down before it's started again
+		for _, k := range []heldKey{{name, true}, {name, false}} {
+			if t, ok := w.held[k]; ok {
+				release = append(release, t)
+				delete(w.held, k)
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	zap.L().Info("resumed target", zap.String("target", name), zap.Int("held", len(release)))
+	for _, t := range release {
+		w.queue.Push(t)
+	}
+	return nil
+}
+
+// Paused reports whether the target is paused, either on its own or because
+// every target is.
+func (w *GitWatcher) Paused(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pausedAll || w.paused[name]
+}
+
+// PauseAll stops tasks for every target from being executed by creating the
+// pause file. Repositories are still watched and the latest task for each
+// target is held until they're resumed.
+func (w *GitWatcher) PauseAll() error {
+	if err := os.MkdirAll(w.directory, 0700); err != nil {
+		return errors.Wrap(err, "failed to create directory for pause file")
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.directory, pauseFile), nil, 0600); err != nil {
+		return errors.Wrap(err, "failed to create pause file")
+	}
+	w.setPausedAll(true)
+	return nil
+}
+
+// ResumeAll removes the pause file and executes the tasks that were held while
+// every target was paused, except those for targets that are paused on their
+// own.
+func (w *GitWatcher) ResumeAll() error {
+	err := os.Remove(filepath.Join(w.directory, pauseFile))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove pause file")
+	}
+	w.setPausedAll(false)
+	return nil
+}
+
+// PausedAll reports whether every target is paused
+func (w *GitWatcher) PausedAll() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pausedAll
+}
+
+func (w *GitWatcher) watchPauseFile() {
+	t := time.NewTicker(pauseFileInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.checkPauseFile()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// checkPauseFile pauses or resumes every target if the pause file was created
+// or removed by hand.
+func (w *GitWatcher) checkPauseFile() {
+	_, err := os.Stat(filepath.Join(w.directory, pauseFile))
+	w.setPausedAll(err == nil)
+}
+
+func (w *GitWatcher) setPausedAll(paused bool) {
+	w.mu.Lock()
+	if w.pausedAll == paused {
+		w.mu.Unlock()
+		return
+	}
+	w.pausedAll = paused
+	release := []task.ExecutionTask{}
+	if !paused {
+		for k, t := range w.held {
+			if !w.paused[k.name] {
+				release = append(release, t)
+				delete(w.held, k)
+			}
+		}
+	}
+	order := w.state.Targets
+	w.mu.Unlock()
+
+	if paused {
+		zap.L().Info("paused all targets")
+		return
+	}
+	zap.L().Info("resumed all targets", zap.Int("held", len(release)))
+
+	// targets are shut down before the rest are started, in the same order as
+	// they would have been if they weren't paused.
+	index := make(map[string]int)
+	for i, t := range order {
+		index[t.Name] = i
+	}
+	sort.SliceStable(release, func(i, j int) bool {
+		a, b := release[i], release[j]
+		if a.Shutdown != b.Shutdown {
+			return a.Shutdown
+		}
+		if a.Shutdown {
+			return index[a.Target.Name] > index[b.Target.Name]
+		}
+		return index[a.Target.Name] < index[b.Target.Name]
+	})
+	for _, t := range release {
+		w.queue.Push(t)
+	}
+}
+
+// hold keeps the task back if its target is paused, replacing any task for the
+// same action that was already held for it. A `down` replaces a held `up` too,
+// since the target is either being removed or restarted with a later `up`.
+func (w *GitWatcher) hold(t task.ExecutionTask) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.pausedAll && !w.paused[t.Target.Name] {
+		return false
+	}
+	zap.L().Debug("holding task for paused target",
+		zap.String("target", t.Target.Name),
+		zap.Bool("shutdown", t.Shutdown))
+	if t.Shutdown {
+		delete(w.held, heldKey{t.Target.Name, false})
+	}
+	w.held[heldKey{t.Target.Name, t.Shutdown}] = t
+	return true
+}
+
+func (w *GitWatcher) hasTarget(name string) bool {
+	for _, t := range w.GetState().Targets {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/task"
+)
+
+func TestPauseAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-pause")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	// the host is paused by hand before the daemon starts
+	require.NoError(t, os.MkdirAll(cache, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache, pauseFile), nil, 0600))
+
+	bus := make(chan task.ExecutionTask, 16)
+	gw := NewGitWatcher(cache, bus, time.Hour, 0, nil)
+	go gw.Start() //nolint:errcheck
+	defer gw.Stop()
+
+	require.NoError(t, gw.SetState(config.State{Targets: []task.Target{
+		{Name: "db", RepoURL: up.path, Up: []string{"true"}},
+		{Name: "app", RepoURL: up.path, Up: []string{"true"}},
+	}}))
+	assert.True(t, gw.PausedAll())
+	assert.True(t, gw.Paused("app"))
+	assertNoTask(t, bus)
+
+	// a target paused on its own stays paused when the host is resumed
+	require.NoError(t, gw.Pause("app"))
+	require.NoError(t, gw.ResumeAll())
+	assert.False(t, gw.PausedAll())
+	_, err = os.Stat(filepath.Join(cache, pauseFile))
+	assert.True(t, os.IsNotExist(err))
+
+	ex := <-bus
+	assert.Equal(t, "db", ex.Target.Name)
+	assertNoTask(t, bus)
+
+	require.NoError(t, gw.Resume("app"))
+	ex = <-bus
+	assert.Equal(t, "app", ex.Target.Name)
+
+	// only the latest task is run once the host is resumed
+	require.NoError(t, gw.PauseAll())
+	require.NoError(t, gw.Trigger("db"))
+	require.NoError(t, gw.Trigger("db"))
+	time.Sleep(100 * time.Millisecond)
+	assertNoTask(t, bus)
+
+	// removing the pause file by hand resumes the host too
+	require.NoError(t, os.Remove(filepath.Join(cache, pauseFile)))
+	gw.checkPauseFile()
+	ex = <-bus
+	assert.Equal(t, "db", ex.Target.Name)
+	assert.Equal(t, task.TriggerManual, ex.Env["PICO_TRIGGER"])
+	assertNoTask(t, bus)
+}
+
+func TestPauseHoldsRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-pause")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+
+	bus := make(chan task.ExecutionTask, 16)
+	gw := NewGitWatcher(filepath.Join(dir, "cache"), bus, time.Hour, 0, nil)
+	started := make(chan error, 1)
+	go func() { started <- gw.Start() }()
+
+	app := task.Target{Name: "app", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}, OnChange: task.OnChangeRestart}
+	require.NoError(t, gw.SetState(config.State{Targets: []task.Target{app}}))
+	gw.Finished(<-bus, nil)
+
+	// both the `down` and the `up` of the restart are held
+	require.NoError(t, gw.Pause("app"))
+	app.Up = []string{"true", "again"}
+	require.NoError(t, gw.SetState(config.State{Targets: []task.Target{app}}))
+	assertNoTask(t, bus)
+
+	require.NoError(t, gw.Resume("app"))
+	ex := <-bus
+	assert.True(t, ex.Shutdown)
+	ex = <-bus
+	assert.False(t, ex.Shutdown)
+	assert.Equal(t, app.Up, ex.Target.Up)
+	gw.Finished(ex, nil)
+
+	// a paused target is left running when the daemon shuts down
+	require.NoError(t, gw.Pause("app"))
+	gw.Stop()
+	require.NoError(t, <-started)
+	assert.Empty(t, gw.ShutdownTasks())
+
+	s, err := loadState(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+	require.Len(t, s.State.Targets, 1)
+	assert.Equal(t, "app", s.State.Targets[0].Name)
+}
+
+func assertNoTask(t *testing.T, bus chan task.ExecutionTask) {
+	select {
+	case ex := <-bus:
+		t.Fatalf("unexpected task for %s", ex.Target.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,10 +16,19 @@ import (
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 
 	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/events"
+	"github.com/picostack/pico/metrics"
 	"github.com/picostack/pico/secret"
 	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/tracing"
+	"github.com/picostack/pico/watchdog"
 )
 
+// maxPendingTasks is the number of tasks that can wait for the executor before
+// the oldest are dropped. Tasks for the same target are coalesced so this is
+// only reached with a very large number of targets.
+const maxPendingTasks = 256
+
 var _ Watcher = &GitWatcher{}
 
 // GitWatcher implements a Watcher for monitoring Git repositories and executing
@@ -26,17 +37,39 @@ type GitWatcher struct {
 	directory     string
 	bus           chan task.ExecutionTask
 	checkInterval time.Duration
+	checkJitter   time.Duration
 	secrets       secret.Store
 
-	targetsWatcher *gitwatch.Session
-	state          config.State
-
-	initialised bool
-	initialise  chan bool
-	newState    chan config.State
-	stateReq    chan struct{}
-	stateRes    chan config.State
-	errors      chan error
+	watchers map[string]*targetWatcher // the session for each target, by name
+	state    config.State
+	queued   map[string]string // last commit queued for each target since starting
+	queue    *task.Queue       // tasks waiting to be sent to the executor
+	restored sync.Once         // loads the persisted state before first use
+	saving   sync.Mutex        // serialises writes of the persisted state
+
+	// guards the fields below, along with writes to state since it's read from
+	// other goroutines.
+	mu              sync.Mutex
+	applied         []task.Target     // deployed targets, in the order they started
+	commits         map[string]string // last commit deployed for each target
+	failed          map[string]string // last commit that failed its health check
+	restoredEnv     map[string]string // hashes of the env of each restored target
+	initialised     bool
+	pending         *config.State                  // the latest state waiting to be applied
+	pendingCtx      context.Context                // carries the trace of the pending state
+	lastReconfigure time.Time                      // when a state was last applied
+	paused          map[string]bool                // targets that are not being executed
+	pausedAll       bool                           // no targets are being executed
+	held            map[heldKey]task.ExecutionTask // latest task of each action for paused targets
+
+	initialise chan bool
+	newState   chan struct{}
+	stop       chan struct{}
+	stopped    chan struct{}
+	syncs      chan func(string) bool
+	runs       chan string
+	events     chan gitwatch.Event
+	errors     chan error
 }
 
 // NewGitWatcher creates a new watcher with all necessary parameters
@@ -44,38 +77,74 @@ func NewGitWatcher(
 	directory string,
 	bus chan task.ExecutionTask,
 	checkInterval time.Duration,
+	checkJitter time.Duration,
 	secrets secret.Store,
 ) *GitWatcher {
 	return &GitWatcher{
 		directory:     directory,
 		bus:           bus,
 		checkInterval: checkInterval,
+		checkJitter:   checkJitter,
 		secrets:       secrets,
+		watchers:      make(map[string]*targetWatcher),
+		queued:        make(map[string]string),
+		commits:       make(map[string]string),
+		failed:        make(map[string]string),
+		queue:         task.NewQueue(maxPendingTasks),
+		paused:        make(map[string]bool),
+		held:          make(map[heldKey]task.ExecutionTask),
 
 		initialise: make(chan bool),
-		newState:   make(chan config.State, 16),
-		stateReq:   make(chan struct{}),
-		stateRes:   make(chan config.State),
+		newState:   make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		syncs:      make(chan func(string) bool, 16),
+		runs:       make(chan string, 16),
+		events:     make(chan gitwatch.Event, 16),
 		errors:     make(chan error, 16),
 	}
 }
 
-func (w *GitWatcher) __waitpoint__start_wait_init() {
-	<-w.initialise
+func (w *GitWatcher) __waitpoint__start_wait_init() (stopped bool) {
+	defer watchdog.Enter("start_wait_init")()
+	select {
+	case <-w.initialise:
+	case <-w.stop:
+		return true
+	}
+	return
 }
 
-func (w *GitWatcher) __waitpoint__start_select_states() (err error) {
+func (w *GitWatcher) __waitpoint__start_select_states() (stopped bool, err error) {
 	select {
-	case newState := <-w.newState:
+	case <-w.stop:
+		return true, nil
+
+	case <-w.newState:
+		w.mu.Lock()
+		newState, ctx := w.pending, w.pendingCtx
+		w.pending, w.pendingCtx = nil, nil
+		w.mu.Unlock()
+		if newState == nil {
+			return false, nil
+		}
+
 		zap.L().Debug("git watcher received new state",
 			zap.Any("new_state", newState))
 
-		return w.doReconfigure(newState)
+		defer watchdog.Enter("reconfigure")()
+		return false, w.doReconfigure(ctx, *newState)
+
+	case match := <-w.syncs:
+		defer watchdog.Enter("sync")()
+		w.doSync(match)
 
-	case <-w.stateReq:
-		w.stateRes <- w.state
+	case name := <-w.runs:
+		defer watchdog.Enter("run")()
+		w.doRun(name)
 
-	case event := <-w.targetsWatcher.Events:
+	case event := <-w.events:
+		defer watchdog.Enter("handle_event")()
 		zap.L().Debug("git watcher received a target event",
 			zap.Any("new_state", event))
 
@@ -85,56 +154,231 @@ func (w *GitWatcher) __waitpoint__start_select_states() (err error) {
 				zap.Error(e))
 		}
 
-	case e := <-errorMultiplex(w.errors, w.targetsWatcher.Errors):
+	case e := <-w.errors:
 		zap.L().Error("git error",
 			zap.Error(e))
 	}
 	return
 }
 
-// Start runs the watcher loop and blocks until a fatal error occurs
+// Start runs the watcher loop and blocks until a fatal error occurs or the
+// watcher is stopped.
 func (w *GitWatcher) Start() error {
 	zap.L().Debug("git watcher initialising, waiting for first state to be set")
 
+	go w.dispatch()
+	go w.watchPauseFile()
+	defer func() {
+		w.queue.Close()
+		close(w.stopped)
+	}()
+
 	// wait for the first config event to set the initial state
-	w.__waitpoint__start_wait_init()
+	if w.__waitpoint__start_wait_init() {
+		return nil
+	}
 
 	zap.L().Debug("git watcher initialised", zap.Any("initial_state", w.state))
 
 	for {
-		err := w.__waitpoint__start_select_states()
+		stopped, err := w.__waitpoint__start_select_states()
 		if err != nil {
 			return err
 		}
+		if stopped {
+			zap.L().Debug("git watcher stopped")
+			return nil
+		}
+	}
+}
+
+// Stop waits for the watcher loop to finish what it's doing and stops it. Any
+// tasks that were already queued are still sent to the bus, which is closed
+// once they have been. Stop must only be called once, after Start.
+func (w *GitWatcher) Stop() {
+	close(w.stop)
+	<-w.stopped
+	for _, tw := range w.watchers {
+		tw.Close()
 	}
 }
 
+// ShutdownTasks returns tasks that run the `down` commands of every target, in
+// the reverse of the order they were started in so dependants stop first. It
+// must only be called once the watcher has been stopped. Each target is removed
+// from the persisted state once its `down` has run, and targets without one
+// straight away, so they are all deployed again on the next start. Paused
+// targets are left running and stay deployed, like they would for any other
+// task.
+func (w *GitWatcher) ShutdownTasks() (tasks []task.ExecutionTask) {
+	for i := len(w.state.Targets) - 1; i >= 0; i-- {
+		t := w.state.Targets[i]
+		if w.Paused(t.Name) {
+			zap.L().Info("leaving paused target running", zap.String("target", t.Name))
+			continue
+		}
+		if !t.HasDown() {
+			w.forget(t.Name)
+			continue
+		}
+		path := filepath.Join(w.directory, getTargetPath(t))
+		tasks = append(tasks, task.ExecutionTask{
+			Target:   t,
+			Path:     path,
+			Shutdown: true,
+			Env:      w.getTaskEnv(t, path, true, task.TriggerShutdown),
+		})
+	}
+	w.persist()
+	return
+}
+
 // performs a reconfigure:
-//   - diffs the new state against the old state to build a list of +/-
+//   - diffs the new state against the old state
 //   - creates a new targets watcher
 //   - executs the necessary targets - first shut down old ones, then create new
 //   - sets the watcher state field to the new state
-func (w *GitWatcher) doReconfigure(newState config.State) error {
-	additions, removals := task.DiffTargets(w.state.Targets, newState.Targets)
+func (w *GitWatcher) doReconfigure(ctx context.Context, newState config.State) (err error) {
+	ctx, span := tracing.Start(ctx, "watcher.reconfigure")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	w.restoreEnv(newState.Targets)
+	diff := task.DiffTargets(w.state.Targets, newState.Targets)
+	span.SetAttribute("targets.added", strconv.Itoa(len(diff.Added)))
+	span.SetAttribute("targets.removed", strconv.Itoa(len(diff.Removed)))
+	span.SetAttribute("targets.changed", strconv.Itoa(len(diff.Changed)))
+	changed := []task.Target{}
+	for _, c := range diff.Changed {
+		changed = append(changed, c.New)
+	}
+	events.Publish(events.Event{
+		Type:    events.StateDiffed,
+		Added:   targetNames(diff.Added),
+		Removed: targetNames(diff.Removed),
+		Changed: targetNames(changed),
+	})
+	w.mu.Lock()
 	w.state = newState
+	w.mu.Unlock()
 
-	err := w.watchTargets()
+	err = w.watchTargets()
 	if err != nil {
 		return err
 	}
 
-	// out with the old, in with the new!
-	w.executeTargets(removals, true)
-	w.executeTargets(additions, false)
+	// targets seen for the first time only run if they ask to, the others
+	// just have their commit recorded so they run on the next one.
+	deploy := []task.Target{}
+	for _, t := range diff.Added {
+		if !t.RunsInitially() {
+			w.skipInitialRun(t)
+			continue
+		}
+		deploy = append(deploy, t)
+	}
+
+	// removed targets without a `down` have nothing to run, so they're just
+	// forgotten
+	removed := []task.Target{}
+	for _, t := range diff.Removed {
+		if !t.HasDown() {
+			w.forget(t.Name)
+			continue
+		}
+		removed = append(removed, t)
+	}
+
+	// changed targets are either restarted or just have `up` run again, which
+	// is all a restart amounts to for targets without a `down`
+	restarts := []task.Target{}
+	for _, c := range diff.Changed {
+		if c.Restart() && c.Old.HasDown() {
+			restarts = append(restarts, c.Old)
+		}
+		deploy = append(deploy, c.New)
+	}
+
+	// out with the old, in with the new! Targets are stopped in the reverse of
+	// the order of the old state and started in the order of the new state, so
+	// dependants are stopped before and started after their dependencies.
+	w.executeTargets(ctx, reversed(removed), true, task.TriggerRemove)
+	w.executeTargets(ctx, reversed(restarts), true, task.TriggerConfig)
+	w.executeTargets(ctx, inOrder(deploy, newState.Targets), false, task.TriggerConfig)
+
+	w.persist()
+
+	w.mu.Lock()
+	w.lastReconfigure = time.Now()
+	w.mu.Unlock()
+	metrics.Reconfigurations.Inc()
+	metrics.LastReconfiguration.SetToCurrentTime()
 
 	return nil
 }
 
-func (w *GitWatcher) doInit(state config.State) error {
-	if err := w.doReconfigure(state); err != nil {
+// inOrder sorts the targets by their position in order
+func inOrder(targets, order []task.Target) []task.Target {
+	index := make(map[string]int)
+	for i, t := range order {
+		index[t.Name] = i
+	}
+	sorted := append([]task.Target{}, targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return index[sorted[i].Name] < index[sorted[j].Name]
+	})
+	return sorted
+}
+
+func targetNames(targets []task.Target) []string {
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.Name
+	}
+	return names
+}
+
+func reversed(targets []task.Target) []task.Target {
+	r := make([]task.Target, len(targets))
+	for i, t := range targets {
+		r[len(targets)-1-i] = t
+	}
+	return r
+}
+
+// skipInitialRun records the target's current commit without running it, so
+// the next commit is handled as a change from this one.
+func (w *GitWatcher) skipInitialRun(t task.Target) {
+	path := filepath.Join(w.directory, getTargetPath(t))
+	info, err := getCommitInfo(path, "")
+	if err != nil {
+		zap.L().Warn("could not read commit of target with initial run disabled",
+			zap.String("target", t.Name),
+			zap.Error(err))
+		return
+	}
+	zap.L().Debug("skipping initial run of target",
+		zap.String("target", t.Name),
+		zap.String("commit", info.SHA))
+	w.mu.Lock()
+	w.deployed(t, info.SHA)
+	w.mu.Unlock()
+}
+
+// doInit applies the first state, diffing it against the state persisted by
+// the previous run if there is one.
+func (w *GitWatcher) doInit(ctx context.Context, state config.State) error {
+	w.restored.Do(w.restore)
+	w.checkPauseFile()
+	if err := w.doReconfigure(ctx, state); err != nil {
 		return err
 	}
+	w.catchUp()
+	w.mu.Lock()
 	w.initialised = true
+	w.mu.Unlock()
 	w.initialise <- true
 	return nil
 }
@@ -143,81 +387,138 @@ func (w *GitWatcher) doInit(state config.State) error {
 // Upon state being updated, the watcher dispatches an event to its own channel
 // to instruct the daemon loop to reconfigure. The reason for this is that loop
 // keeps the whole system in sync, so reconfigurations don't happen mid way
-// through a target event.
+// through a target event. SetState never blocks once the watcher has been
+// initialised: if the loop is busy, only the latest state is kept and applied
+// when it's free, since any states set in between are already out of date.
 func (w *GitWatcher) SetState(state config.State) error {
+	return w.SetStateContext(context.Background(), state)
+}
+
+// SetStateContext is SetState for a state generated as part of a trace, the
+// reconfiguration and the tasks it queues are recorded in the same trace.
+func (w *GitWatcher) SetStateContext(ctx context.Context, state config.State) error {
+	w.mu.Lock()
 	if !w.initialised {
-		return w.doInit(state)
+		w.mu.Unlock()
+		return w.doInit(ctx, state)
+	}
+	if w.pending != nil {
+		zap.L().Debug("replacing pending state that has not been applied yet")
+	}
+	w.pending = &state
+	w.pendingCtx = ctx
+	w.mu.Unlock()
+
+	select {
+	case w.newState <- struct{}{}:
+	default:
 	}
-	w.newState <- state
 	return nil
 }
 
-// GetState implements Watcher
+// GetState implements Watcher, it returns the state that was last applied. Before
+// the first state is set, that's the state persisted by the previous run.
 func (w *GitWatcher) GetState() config.State {
-	if !w.initialised {
-		return w.state
+	w.restored.Do(w.restore)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+// QueueLength returns the number of tasks waiting to be sent to the executor
+func (w *GitWatcher) QueueLength() int {
+	return w.queue.Len()
+}
+
+// Sync implements webhook.Syncer, the matching targets are fetched by the daemon
+// loop so any new commits are handled straight away.
+func (w *GitWatcher) Sync(match func(url string) bool) {
+	select {
+	case w.syncs <- match:
+	default:
+		zap.L().Warn("too many pending sync requests, dropping request")
 	}
-	w.stateReq <- struct{}{}
-	return <-w.stateRes
 }
 
-// watchTargets creates or restarts the targets watcher.
-func (w *GitWatcher) watchTargets() (err error) {
-	targetRepos := make([]gitwatch.Repository, len(w.state.Targets))
-	for i, t := range w.state.Targets {
-		dir := getTargetPath(t)
-		auth, err := w.getAuthForTarget(t)
+// doSync fetches every target whose repository matches and handles any new
+// commits found rather than waiting for the next check interval.
+func (w *GitWatcher) doSync(match func(string) bool) {
+	for _, t := range w.state.Targets {
+		if !match(t.RepoURL) {
+			continue
+		}
+		event, err := w.fetchTarget(t)
 		if err != nil {
-			return err
+			zap.L().Error("failed to sync target",
+				zap.String("target", t.Name),
+				zap.Error(err))
+			continue
+		}
+		if event == nil {
+			zap.L().Debug("sync found no changes", zap.String("target", t.Name))
+			continue
 		}
-		zap.L().Debug("assigned target", zap.String("url", t.RepoURL), zap.String("directory", dir))
-		targetRepos[i] = gitwatch.Repository{
-			URL:       t.RepoURL,
-			Branch:    t.Branch,
-			Directory: dir,
-			Auth:      auth,
+		if err = w.handle(*event); err != nil {
+			zap.L().Error("failed to handle event",
+				zap.String("url", event.URL),
+				zap.Error(err))
 		}
 	}
+}
 
-	if w.targetsWatcher != nil {
-		w.targetsWatcher.Close()
+// fetchTarget pulls the target's repository using whichever session manages it
+// and returns an event if there were any changes. The sessions serialise this
+// with their own polling.
+func (w *GitWatcher) fetchTarget(t task.Target) (*gitwatch.Event, error) {
+	tw, ok := w.watchers[t.Name]
+	if !ok {
+		return nil, nil
 	}
-	w.targetsWatcher, err = gitwatch.New(
-		context.TODO(),
-		targetRepos,
-		w.checkInterval,
-		w.directory,
-		nil,
-		false)
-	w.targetsWatcher.UseForce = true
-	if err != nil {
-		return errors.Wrap(err, "failed to watch targets")
+	path := filepath.Join(w.directory, getTargetPath(t))
+
+	if tw.refs != nil {
+		changed, err := tw.refs.check(tw.refs.repos[0])
+		if err != nil || !changed {
+			return nil, err
+		}
+		return &gitwatch.Event{URL: t.RepoURL, Path: path, Timestamp: time.Now()}, nil
 	}
 
-	errs := make(chan error)
-	go func() {
-		e := w.targetsWatcher.Run()
-		if e != nil && !errors.Is(e, context.Canceled) {
-			errs <- e
+	return tw.branch.Pull()
+}
+
+// watchTargets brings the target watchers in line with the current state. Only
+// targets that are new or whose repository settings changed get a new session,
+// the sessions of every other target are left running.
+func (w *GitWatcher) watchTargets() error {
+	wanted := make(map[string]task.Target)
+	for _, t := range w.state.Targets {
+		wanted[t.Name] = t
+	}
+	for name, tw := range w.watchers {
+		if t, ok := wanted[name]; ok && tw.key == w.getWatchKey(t) {
+			tw.target = t
+			continue
 		}
-		// forward errors from the watcher to the central for-select above
-		w.errors <- <-w.targetsWatcher.Errors
-	}()
-	zap.L().Debug("created targets watcher, awaiting setup")
+		zap.L().Debug("closing target watcher", zap.String("target", name))
+		tw.Close()
+		delete(w.watchers, name)
+	}
 
-	err = w.__waitpoint__watch_targets(errs)
+	for _, t := range w.state.Targets {
+		if _, ok := w.watchers[t.Name]; ok {
+			continue
+		}
+		tw, err := w.watchTarget(t)
+		if err != nil {
+			return errors.Wrapf(err, "failed to watch target %s", t.Name)
+		}
+		w.watchers[t.Name] = tw
+	}
 
 	zap.L().Debug("targets watcher initialised")
 
-	return
-}
-
-func (w *GitWatcher) __waitpoint__watch_targets(errs chan error) (err error) {
-	select {
-	case <-w.targetsWatcher.InitialDone:
-	case err = <-errs:
-	}
-	return
+	return nil
 }
 
 func (w *GitWatcher) handle(e gitwatch.Event) (err error) {
@@ -229,7 +530,39 @@ func (w *GitWatcher) handle(e gitwatch.Event) (err error) {
 		zap.String("target", target.Name),
 		zap.String("url", target.RepoURL),
 		zap.Time("timestamp", e.Timestamp))
-	w.__waitpoint__send_target_task(target, e.Path, false)
+
+	w.mu.Lock()
+	previous := w.commits[target.Name]
+	failed := w.failed[target.Name]
+	w.mu.Unlock()
+	filtered := len(target.Paths) > 0 || len(target.IgnorePaths) > 0
+	info, err := getCommitInfo(e.Path, previous)
+	if err != nil {
+		zap.L().Warn("could not read commit, running target anyway",
+			zap.String("target", target.Name),
+			zap.Error(err))
+	} else if info.SHA != "" && info.SHA == w.queued[target.Name] {
+		zap.L().Debug("commit was already queued, skipping event",
+			zap.String("target", target.Name),
+			zap.String("commit", info.SHA))
+		return nil
+	} else if info.SHA != "" && info.SHA == failed {
+		zap.L().Warn("commit previously failed its health check, skipping event",
+			zap.String("target", target.Name),
+			zap.String("commit", info.SHA),
+			zap.String("previous", previous))
+		return nil
+	} else if filtered && info.Files != nil && !target.Matches(info.Files) {
+		zap.L().Debug("no relevant files changed, skipping event",
+			zap.String("target", target.Name),
+			zap.Strings("files", info.Files))
+		return nil
+	}
+
+	ctx, span := tracing.Start(context.Background(), "watcher.commit")
+	span.SetAttribute("target", target.Name)
+	w.queueTargetTask(ctx, target, e.Path, false, task.TriggerCommit)
+	span.End()
 	return nil
 }
 
@@ -240,11 +573,27 @@ func getTargetPath(t task.Target) string {
 	return t.Name
 }
 
-func (w GitWatcher) getAuthForTarget(t task.Target) (transport.AuthMethod, error) {
-	for _, a := range w.state.AuthMethods {
+func (w *GitWatcher) getAuthForTarget(t task.Target) (transport.AuthMethod, error) {
+	return w.resolveAuth(w.state.AuthMethods, t)
+}
+
+// AuthForTarget returns the credentials the target's repository is accessed
+// with, so they can be reused for the forge's API. Unlike the watcher's own
+// lookups it's safe to call from other goroutines.
+func (w *GitWatcher) AuthForTarget(t task.Target) (transport.AuthMethod, error) {
+	return w.resolveAuth(w.GetState().AuthMethods, t)
+}
+
+func (w *GitWatcher) resolveAuth(methods []config.AuthMethod, t task.Target) (transport.AuthMethod, error) {
+	for _, a := range methods {
 		if a.Name == t.Auth {
 			s, err := w.secrets.GetSecretsForTarget(a.Path)
 			if err != nil {
+				events.Publish(events.Event{
+					Type:   events.SecretFailed,
+					Target: t.Name,
+					Error:  err.Error(),
+				})
 				return nil, err
 			}
 			username, ok := s[a.UserKey]
@@ -265,17 +614,18 @@ func (w GitWatcher) getAuthForTarget(t task.Target) (transport.AuthMethod, error
 	return nil, nil
 }
 
-func (w GitWatcher) executeTargets(targets []task.Target, shutdown bool) {
+func (w *GitWatcher) executeTargets(ctx context.Context, targets []task.Target, shutdown bool, trigger string) {
 	zap.L().Debug("executing all targets",
 		zap.Bool("shutdown", shutdown),
+		zap.String("trigger", trigger),
 		zap.Int("targets", len(targets)))
 
 	for _, t := range targets {
-		w.__waitpoint__send_target_task(t, filepath.Join(w.directory, getTargetPath(t)), shutdown)
+		w.queueTargetTask(ctx, t, filepath.Join(w.directory, getTargetPath(t)), shutdown, trigger)
 	}
 }
 
-func (w GitWatcher) getTarget(path string) (target task.Target, exists bool) {
+func (w *GitWatcher) getTarget(path string) (target task.Target, exists bool) {
 	for _, t := range w.state.Targets {
 		targetPath := filepath.Join(w.directory, getTargetPath(t))
 		if targetPath == path {
@@ -285,32 +635,85 @@ func (w GitWatcher) getTarget(path string) (target task.Target, exists bool) {
 	return
 }
 
-func (w GitWatcher) __waitpoint__send_target_task(target task.Target, path string, shutdown bool) {
-	w.bus <- task.ExecutionTask{
+// queueTargetTask queues a task for the executor without blocking the daemon
+// loop. A pending task for the same target is replaced by the new one.
+func (w *GitWatcher) queueTargetTask(ctx context.Context, target task.Target, path string, shutdown bool, trigger string) {
+	t := task.ExecutionTask{
 		Target:   target,
 		Path:     path,
 		Shutdown: shutdown,
-		Env:      w.state.Env,
+		Env:      w.getTaskEnv(target, path, shutdown, trigger),
+	}
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		t.Env[tracing.EnvVar] = traceparent
+	}
+	if sha := t.Env["PICO_COMMIT_SHA"]; !shutdown && sha != "" {
+		w.queued[target.Name] = sha
+	}
+	e := events.ForTask(events.TaskQueued, t)
+	if w.hold(t) {
+		e.Result = "held"
+		events.Publish(e)
+		return
+	}
+	events.Publish(e)
+	dropped := w.queue.Push(t)
+	if dropped != nil {
+		zap.L().Warn("too many pending tasks, dropped one",
+			zap.String("target", dropped.Target.Name),
+			zap.Bool("shutdown", dropped.Shutdown))
 	}
 }
 
-func errorMultiplex(chans ...<-chan error) <-chan error {
-	out := make(chan error)
-	go func() {
-		var wg sync.WaitGroup
-		wg.Add(len(chans))
-
-		for _, c := range chans {
-			go func(c <-chan error) {
-				for v := range c {
-					out <- v
-				}
-				wg.Done()
-			}(c)
+// dispatch sends queued tasks to the executor one at a time. Once the watcher
+// has stopped and the queue is empty, it closes the bus.
+func (w *GitWatcher) dispatch() {
+	for {
+		t, ok := w.queue.Next()
+		if !ok {
+			close(w.bus)
+			return
 		}
+		w.__waitpoint__send_target_task(t)
+	}
+}
 
-		wg.Wait()
-		close(out)
-	}()
-	return out
+func (w *GitWatcher) __waitpoint__send_target_task(t task.ExecutionTask) {
+	defer watchdog.Enter("send_target_task")()
+	w.bus <- t
+}
+
+// getTaskEnv builds the environment for an execution task from the global
+// config environment and information about the commit being executed. The
+// previous commit is the last one that was deployed successfully.
+func (w *GitWatcher) getTaskEnv(target task.Target, path string, shutdown bool, trigger string) map[string]string {
+	env := make(map[string]string)
+	for k, v := range w.state.Env {
+		env[k] = v
+	}
+	env["PICO_TARGET_NAME"] = target.Name
+	env["PICO_TRIGGER"] = trigger
+
+	w.mu.Lock()
+	previous := w.commits[target.Name]
+	w.mu.Unlock()
+
+	info, err := getCommitInfo(path, previous)
+	if err != nil {
+		zap.L().Debug("could not read commit information for target",
+			zap.String("target", target.Name),
+			zap.String("path", path),
+			zap.Error(err))
+	}
+	if info.SHA == "" {
+		return env
+	}
+	if target.Branch != "" {
+		info.Branch = target.Branch
+	}
+	for k, v := range info.env() {
+		env[k] = v
+	}
+
+	return env
 }
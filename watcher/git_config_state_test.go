@@ -11,6 +11,9 @@ import (
 )
 
 func TestStateTransitions(t *testing.T) {
+	// pending states are coalesced, so each transition's tasks are received
+	// before the next state is set.
+
 	// add target t01
 	assert.NoError(t, w.SetState(config.State{
 		Targets: []task.Target{{
@@ -22,6 +25,17 @@ func TestStateTransitions(t *testing.T) {
 			"KEY": "VALUE",
 		},
 	}))
+	assert.Equal(t, executed(), task.ExecutionTask{
+		Target: task.Target{
+			Name:    "t01",
+			RepoURL: "https://github.com/picostack/pico-example-target",
+			Up:      []string{"docker-compose", "up", "-d"},
+		},
+		Path:     filepath.Join(".test", "t01"),
+		Shutdown: false,
+		Env:      taskEnv(t, "t01", task.TriggerConfig, ""),
+	})
+
 	// add target t02
 	assert.NoError(t, w.SetState(config.State{
 		Targets: []task.Target{{
@@ -37,55 +51,29 @@ func TestStateTransitions(t *testing.T) {
 			"KEY": "VALUE",
 		},
 	}))
-	// remove target t01
-	assert.NoError(t, w.SetState(config.State{
-		Targets: []task.Target{{
+	assert.Equal(t, executed(), task.ExecutionTask{
+		Target: task.Target{
 			Name:    "t02",
 			RepoURL: "https://github.com/picostack/pico-example-target",
 			Up:      []string{"git", "status"},
-		}},
-		Env: map[string]string{
-			"KEY": "VALUE",
-		},
-	}))
-	// remove target t02
-	assert.NoError(t, w.SetState(config.State{
-		Targets: []task.Target{},
-		Env: map[string]string{
-			"KEY": "VALUE",
-		},
-	}))
-	// remove env
-	assert.NoError(t, w.SetState(config.State{
-		Targets: []task.Target{},
-		Env:     map[string]string{},
-	}))
-
-	assert.Equal(t, <-bus, task.ExecutionTask{
-		Target: task.Target{
-			Name:    "t01",
-			RepoURL: "https://github.com/picostack/pico-example-target",
-			Up:      []string{"docker-compose", "up", "-d"},
 		},
-		Path:     filepath.Join(".test", "t01"),
+		Path:     filepath.Join(".test", "t02"),
 		Shutdown: false,
-		Env: map[string]string{
-			"KEY": "VALUE",
-		},
+		Env:      taskEnv(t, "t02", task.TriggerConfig, ""),
 	})
-	assert.Equal(t, <-bus, task.ExecutionTask{
-		Target: task.Target{
+
+	// remove target t01
+	assert.NoError(t, w.SetState(config.State{
+		Targets: []task.Target{{
 			Name:    "t02",
 			RepoURL: "https://github.com/picostack/pico-example-target",
 			Up:      []string{"git", "status"},
-		},
-		Path:     filepath.Join(".test", "t02"),
-		Shutdown: false,
+		}},
 		Env: map[string]string{
 			"KEY": "VALUE",
 		},
-	})
-	assert.Equal(t, <-bus, task.ExecutionTask{
+	}))
+	assert.Equal(t, executed(), task.ExecutionTask{
 		Target: task.Target{
 			Name:    "t01",
 			RepoURL: "https://github.com/picostack/pico-example-target",
@@ -93,11 +81,17 @@ func TestStateTransitions(t *testing.T) {
 		},
 		Path:     filepath.Join(".test", "t01"),
 		Shutdown: true,
+		Env:      taskEnv(t, "t01", task.TriggerRemove, headSHA(t, "t01")),
+	})
+
+	// remove target t02
+	assert.NoError(t, w.SetState(config.State{
+		Targets: []task.Target{},
 		Env: map[string]string{
 			"KEY": "VALUE",
 		},
-	})
-	assert.Equal(t, <-bus, task.ExecutionTask{
+	}))
+	assert.Equal(t, executed(), task.ExecutionTask{
 		Target: task.Target{
 			Name:    "t02",
 			RepoURL: "https://github.com/picostack/pico-example-target",
@@ -105,8 +99,12 @@ func TestStateTransitions(t *testing.T) {
 		},
 		Path:     filepath.Join(".test", "t02"),
 		Shutdown: true,
-		Env: map[string]string{
-			"KEY": "VALUE",
-		},
+		Env:      taskEnv(t, "t02", task.TriggerRemove, headSHA(t, "t02")),
 	})
+
+	// remove env
+	assert.NoError(t, w.SetState(config.State{
+		Targets: []task.Target{},
+		Env:     map[string]string{},
+	}))
 }
@@ -25,7 +25,7 @@ func TestGitEvents(t *testing.T) {
 		},
 	}))
 	// assert receive
-	assert.Equal(t, <-bus, task.ExecutionTask{
+	assert.Equal(t, executed(), task.ExecutionTask{
 		Target: task.Target{
 			Name:    "t01",
 			RepoURL: "https://github.com/picostack/pico-example-target",
@@ -33,9 +33,7 @@ func TestGitEvents(t *testing.T) {
 		},
 		Path:     filepath.Join(".test", "t01"),
 		Shutdown: false,
-		Env: map[string]string{
-			"KEY": "VALUE",
-		},
+		Env:      taskEnv(t, "t01", task.TriggerConfig, ""),
 	})
 
 	assert.NoError(t, w.handle(gitwatch.Event{
@@ -44,7 +42,7 @@ func TestGitEvents(t *testing.T) {
 		Timestamp: time.Now(),
 	}))
 
-	assert.Equal(t, <-bus, task.ExecutionTask{
+	assert.Equal(t, executed(), task.ExecutionTask{
 		Target: task.Target{
 			Name:    "t01",
 			RepoURL: "https://github.com/picostack/pico-example-target",
@@ -52,8 +50,6 @@ func TestGitEvents(t *testing.T) {
 		},
 		Path:     filepath.Join(".test", "t01"),
 		Shutdown: false,
-		Env: map[string]string{
-			"KEY": "VALUE",
-		},
+		Env:      taskEnv(t, "t01", task.TriggerCommit, headSHA(t, "t01")),
 	})
 }
@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/task"
+)
+
+func TestTargetCheckInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-interval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	first := up.commit("one")
+
+	// the global interval is far too long for the test, so the event can only
+	// arrive if the target's own interval is used.
+	tasks := make(chan task.ExecutionTask, 16)
+	gw := NewGitWatcher(filepath.Join(dir, "cache"), tasks, time.Hour, 0, nil)
+	go gw.Start() //nolint:errcheck
+
+	target := task.Target{
+		Name:          "fast",
+		RepoURL:       up.path,
+		Up:            []string{"true"},
+		CheckInterval: task.Duration(100 * time.Millisecond),
+	}
+	require.NoError(t, gw.SetState(config.State{Targets: []task.Target{target}}))
+
+	initial := <-tasks
+	assert.Equal(t, first, initial.Env["PICO_COMMIT_SHA"])
+	assert.Equal(t, task.TriggerConfig, initial.Env["PICO_TRIGGER"])
+	gw.Finished(initial, nil)
+
+	second := up.commit("two")
+
+	select {
+	case next := <-tasks:
+		assert.Equal(t, second, next.Env["PICO_COMMIT_SHA"])
+		assert.Equal(t, first, next.Env["PICO_PREVIOUS_SHA"])
+		assert.Equal(t, "two", next.Env["PICO_CHANGED_FILES"])
+		assert.Equal(t, task.TriggerCommit, next.Env["PICO_TRIGGER"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("target was not checked at its own interval")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	assert.Equal(t, time.Second, Jitter(time.Second, 0))
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := Jitter(time.Second, time.Second)
+		assert.True(t, d >= time.Second && d < 2*time.Second)
+		seen[d] = true
+	}
+
+	// each poll gets its own offset
+	assert.True(t, len(seen) > 1)
+}
@@ -0,0 +1,163 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/task"
+)
+
+func TestIncrementalReconfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-reconfigure")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+
+	tasks := make(chan task.ExecutionTask, 16)
+	gw := NewGitWatcher(filepath.Join(dir, "cache"), tasks, time.Hour, 0, nil)
+
+	t01 := task.Target{Name: "t01", RepoURL: up.path, Up: []string{"true"}}
+	t02 := task.Target{Name: "t02", RepoURL: up.path, Up: []string{"true"}}
+
+	require.NoError(t, gw.doReconfigure(context.Background(), config.State{Targets: []task.Target{t01}}))
+	first := gw.watchers["t01"]
+	require.NotNil(t, first)
+
+	// adding a target leaves the existing session running
+	require.NoError(t, gw.doReconfigure(context.Background(), config.State{Targets: []task.Target{t01, t02}}))
+	assert.Same(t, first, gw.watchers["t01"])
+	assert.NotNil(t, gw.watchers["t02"])
+
+	// changes that don't affect the repository leave the session running
+	t01.Env = map[string]string{"KEY": "VALUE"}
+	require.NoError(t, gw.doReconfigure(context.Background(), config.State{Targets: []task.Target{t01, t02}}))
+	assert.Same(t, first, gw.watchers["t01"])
+	assert.Equal(t, t01, gw.watchers["t01"].target)
+
+	// changing the interval restarts the session
+	t01.CheckInterval = task.Duration(time.Minute)
+	require.NoError(t, gw.doReconfigure(context.Background(), config.State{Targets: []task.Target{t01, t02}}))
+	assert.False(t, first == gw.watchers["t01"], "expected a new session")
+
+	// removing a target closes its session
+	require.NoError(t, gw.doReconfigure(context.Background(), config.State{Targets: []task.Target{t01}}))
+	assert.Len(t, gw.watchers, 1)
+}
+
+func TestSetStateCoalesces(t *testing.T) {
+	tasks := make(chan task.ExecutionTask)
+	gw := NewGitWatcher(".test-coalesce", tasks, time.Hour, 0, nil)
+	gw.initialised = true // the daemon loop isn't running, as if it were busy
+
+	for _, name := range []string{"one", "two", "three"} {
+		done := make(chan error)
+		go func() {
+			done <- gw.SetState(config.State{Env: map[string]string{"NAME": name}})
+		}()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("SetState blocked while the loop was busy")
+		}
+	}
+
+	// only the latest state is kept and the applied state is unchanged
+	require.NotNil(t, gw.pending)
+	assert.Equal(t, "three", gw.pending.Env["NAME"])
+	assert.Empty(t, gw.GetState().Env)
+	assert.Len(t, gw.newState, 1)
+}
+
+func TestReconfigureOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-onchange")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	restart := task.Target{Name: "restart", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}, OnChange: task.OnChangeRestart}
+	source := task.Target{Name: "source", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}, OnChange: task.OnChangeSource}
+	require.Len(t, runWatcher(t, cache, config.State{Targets: []task.Target{restart, source}}), 2)
+
+	// an env change restarts the first but only runs `up` for the second
+	restart.Env = map[string]string{"KEY": "VALUE"}
+	source.Env = map[string]string{"KEY": "VALUE"}
+	tasks := runWatcher(t, cache, config.State{Targets: []task.Target{restart, source}})
+	require.Len(t, tasks, 3)
+
+	assert.Equal(t, "restart", tasks[0].Target.Name)
+	assert.True(t, tasks[0].Shutdown)
+	assert.Nil(t, tasks[0].Target.Env, "the old definition is shut down")
+	assert.Equal(t, task.TriggerConfig, tasks[0].Env["PICO_TRIGGER"])
+
+	assert.Equal(t, "restart", tasks[1].Target.Name)
+	assert.False(t, tasks[1].Shutdown)
+	assert.Equal(t, restart.Env, tasks[1].Target.Env)
+
+	assert.Equal(t, "source", tasks[2].Target.Name)
+	assert.False(t, tasks[2].Shutdown)
+}
+
+func TestReconfigureOnChangeWithoutDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-onchange")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	restart := task.Target{Name: "restart", RepoURL: up.path, Up: []string{"true"}, OnChange: task.OnChangeRestart}
+	require.Len(t, runWatcher(t, cache, config.State{Targets: []task.Target{restart}}), 1)
+
+	// there's no `down` to stop the old definition with, so only `up` is run
+	restart.Env = map[string]string{"KEY": "VALUE"}
+	tasks := runWatcher(t, cache, config.State{Targets: []task.Target{restart}})
+	require.Len(t, tasks, 1)
+	assert.False(t, tasks[0].Shutdown)
+	assert.Equal(t, restart.Env, tasks[0].Target.Env)
+}
+
+func TestReconfigureOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-order")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	// states are sorted by the config so dependencies come first
+	db := task.Target{Name: "db", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}}
+	app := task.Target{Name: "app", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}, DependsOn: []string{"db"}}
+	require.Len(t, runWatcher(t, cache, config.State{Targets: []task.Target{db}}), 1)
+
+	// the app is added and the database changed, the app must start second
+	db.Env = map[string]string{"KEY": "VALUE"}
+	tasks := runWatcher(t, cache, config.State{Targets: []task.Target{db, app}})
+	assert.Equal(t, []string{"db", "app"}, taskNames(tasks))
+
+	// both are removed, the app must stop first
+	tasks = runWatcher(t, cache, config.State{})
+	assert.Equal(t, []string{"app", "db"}, taskNames(tasks))
+}
+
+func taskNames(tasks []task.ExecutionTask) (names []string) {
+	for _, t := range tasks {
+		names = append(names, t.Target.Name)
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/task"
+)
+
+func TestStopAndShutdownTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-shutdown")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	sha := up.commit("one")
+
+	tasks := make(chan task.ExecutionTask, 16)
+	gw := NewGitWatcher(filepath.Join(dir, "cache"), tasks, time.Hour, 0, nil)
+	started := make(chan error, 1)
+	go func() { started <- gw.Start() }()
+
+	targets := []task.Target{
+		{Name: "first", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}},
+		{Name: "nodown", RepoURL: up.path, Up: []string{"true"}},
+		{Name: "last", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}},
+	}
+	require.NoError(t, gw.SetState(config.State{Targets: targets}))
+
+	gw.Stop()
+	require.NoError(t, <-started)
+
+	// the initial tasks are still delivered before the bus is closed
+	names := []string{}
+	for ex := range tasks {
+		names = append(names, ex.Target.Name)
+	}
+	assert.Equal(t, []string{"first", "nodown", "last"}, names)
+
+	shutdown := gw.ShutdownTasks()
+	require.Len(t, shutdown, 2)
+	assert.Equal(t, "last", shutdown[0].Target.Name)
+	assert.Equal(t, "first", shutdown[1].Target.Name)
+	for _, ex := range shutdown {
+		assert.True(t, ex.Shutdown)
+		assert.Equal(t, task.TriggerShutdown, ex.Env["PICO_TRIGGER"])
+		assert.Equal(t, sha, ex.Env["PICO_COMMIT_SHA"])
+	}
+}
@@ -1,10 +1,19 @@
 package watcher
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
 	"github.com/picostack/pico/task"
 
 	_ "github.com/picostack/pico/logger"
@@ -14,8 +23,11 @@ var w *GitWatcher
 var bus chan task.ExecutionTask
 
 func TestMain(m *testing.M) {
+	// start without any state persisted by a previous run
+	os.RemoveAll(".test") //nolint:errcheck
+
 	bus = make(chan task.ExecutionTask, 16)
-	w = NewGitWatcher(".test", bus, time.Second, nil)
+	w = NewGitWatcher(".test", bus, time.Second, 0, nil)
 
 	go func() {
 		if err := w.Start(); err != nil {
@@ -25,3 +37,80 @@ func TestMain(m *testing.M) {
 
 	os.Exit(m.Run())
 }
+
+// executed receives the next task from the shared watcher and reports that it
+// succeeded, as the executor would.
+func executed() task.ExecutionTask {
+	ex := <-bus
+	w.Finished(ex, nil)
+	return ex
+}
+
+func headSHA(t *testing.T, name string) string {
+	return headSHAAt(t, filepath.Join(".test", name))
+}
+
+func headSHAAt(t *testing.T, path string) string {
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	return head.Hash().String()
+}
+
+// taskEnv builds the environment a task is expected to carry for the commit
+// currently checked out for the named target.
+func taskEnv(t *testing.T, name, trigger, previous string) map[string]string {
+	repo, err := git.PlainOpen(filepath.Join(".test", name))
+	require.NoError(t, err)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	commit, err := repo.CommitObject(head.Hash())
+	require.NoError(t, err)
+
+	return map[string]string{
+		"KEY":                 "VALUE",
+		"PICO_TARGET_NAME":    name,
+		"PICO_TRIGGER":        trigger,
+		"PICO_COMMIT_SHA":     head.Hash().String(),
+		"PICO_PREVIOUS_SHA":   previous,
+		"PICO_BRANCH":         head.Name().Short(),
+		"PICO_COMMIT_MESSAGE": strings.TrimSpace(commit.Message),
+		"PICO_COMMIT_AUTHOR":  fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email),
+		"PICO_CHANGED_FILES":  "",
+	}
+}
+
+// upstream is a local repository that targets can be pointed at in tests that
+// don't need a real remote.
+type upstream struct {
+	t    *testing.T
+	path string
+	repo *git.Repository
+}
+
+func newUpstream(t *testing.T, path string) *upstream {
+	repo, err := git.PlainInit(path, false)
+	require.NoError(t, err)
+	return &upstream{t, path, repo}
+}
+
+// commit writes a file named after the commit and commits it, returning the SHA
+func (u *upstream) commit(file string) string {
+	wt, err := u.repo.Worktree()
+	require.NoError(u.t, err)
+	require.NoError(u.t, ioutil.WriteFile(filepath.Join(u.path, file), []byte(file), 0644))
+	_, err = wt.Add(file)
+	require.NoError(u.t, err)
+	h, err := wt.Commit(file, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@pico.sh", When: time.Now()},
+	})
+	require.NoError(u.t, err)
+	return h.String()
+}
+
+// tag creates a lightweight tag pointing at the commit
+func (u *upstream) tag(name, sha string) {
+	_, err := u.repo.CreateTag(name, plumbing.NewHash(sha), nil)
+	require.NoError(u.t, err)
+}
@@ -0,0 +1,269 @@
+package watcher
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+
+	"github.com/picostack/pico/task"
+)
+
+// refRepository is a target repository that follows tags or is pinned to a
+// specific ref rather than following a branch.
+type refRepository struct {
+	target task.Target
+	path   string
+	auth   transport.AuthMethod
+}
+
+// refSession checks out the ref each of a set of repositories should be at. For
+// targets that follow tags, it periodically lists the remote tags and checks out
+// the highest one that matches. Pinned targets are checked out once and then
+// left alone. It mirrors the shape of a BranchSession so the watcher can treat
+// events from both the same way.
+type refSession struct {
+	repos    []refRepository
+	interval time.Duration
+	jitter   time.Duration
+	Events   chan gitwatch.Event
+	Errors   chan error
+	mu       sync.Mutex // held while a repository is checked
+
+	ctx context.Context
+	cf  context.CancelFunc
+}
+
+func newRefSession(ctx context.Context, repos []refRepository, interval, jitter time.Duration) *refSession {
+	ctx2, cf := context.WithCancel(ctx)
+	return &refSession{
+		repos:    repos,
+		interval: interval,
+		jitter:   jitter,
+		Events:   make(chan gitwatch.Event, len(repos)),
+		Errors:   make(chan error, 16),
+		ctx:      ctx2,
+		cf:       cf,
+	}
+}
+
+// Sync checks out the selected ref for every repository once, cloning any that
+// don't exist yet. No events are emitted.
+func (s *refSession) Sync() error {
+	for _, r := range s.repos {
+		if _, err := s.check(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run polls the remote tags of each tag-following repository and emits an event
+// whenever a different tag is checked out. It blocks until the session is closed.
+func (s *refSession) Run() {
+	defer close(s.Errors)
+
+	for {
+		if !wait(s.ctx, Jitter(s.interval, s.jitter)) {
+			return
+		}
+
+		for _, r := range s.repos {
+			if r.target.Ref != "" {
+				continue
+			}
+			changed, err := s.check(r)
+			if err != nil {
+				select {
+				case s.Errors <- err:
+				case <-s.ctx.Done():
+					return
+				}
+				continue
+			}
+			if !changed {
+				continue
+			}
+			select {
+			case s.Events <- gitwatch.Event{
+				URL:       r.target.RepoURL,
+				Path:      r.path,
+				Timestamp: time.Now(),
+			}:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Close stops the session
+func (s *refSession) Close() {
+	s.cf()
+}
+
+// check ensures the repository is cloned and has the selected ref checked out.
+// It returns true if the checkout changed. Checks are serialised so a sync can
+// safely run alongside the session's own polling.
+func (s *refSession) check(r refRepository) (changed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer observeFetch(r.target.RepoURL, time.Now())
+
+	repo, err := git.PlainOpen(r.path)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainCloneContext(s.ctx, r.path, false, &git.CloneOptions{
+			URL:  r.target.RepoURL,
+			Auth: r.auth,
+			Tags: git.AllTags,
+		})
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open repository for %s", r.target.Name)
+	}
+
+	var hash plumbing.Hash
+	if r.target.Ref != "" {
+		hash, err = s.resolvePinned(repo, r)
+	} else {
+		hash, err = s.resolveTag(repo, r)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if head, err := repo.Head(); err == nil && head.Hash() == hash {
+		return false, nil
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get worktree")
+	}
+	if err = wt.Checkout(&git.CheckoutOptions{Hash: hash, Force: true}); err != nil {
+		return false, errors.Wrapf(err, "failed to check out %s", hash)
+	}
+
+	return true, nil
+}
+
+// resolveTag lists the remote's tags and returns the commit of the highest tag
+// that matches the target, fetching it first if necessary.
+func (s *refSession) resolveTag(repo *git.Repository, r refRepository) (plumbing.Hash, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrap(err, "failed to get origin remote")
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: r.auth})
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrapf(err, "failed to list remote tags for %s", r.target.Name)
+	}
+
+	remoteTags := make(map[string]plumbing.Hash)
+	names := []string{}
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			remoteTags[ref.Name().Short()] = ref.Hash()
+			names = append(names, ref.Name().Short())
+		}
+	}
+
+	tag, err := r.target.SelectTag(names)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if tag == "" {
+		return plumbing.ZeroHash, errors.Errorf("no tags in %s match the target %s", r.target.RepoURL, r.target.Name)
+	}
+
+	// only fetch when the tag is missing locally or has been moved upstream
+	local, err := repo.Reference(plumbing.NewTagReferenceName(tag), false)
+	if err != nil || local.Hash() != remoteTags[tag] {
+		if err = s.fetch(repo, r); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if local, err = repo.Reference(plumbing.NewTagReferenceName(tag), false); err != nil {
+			return plumbing.ZeroHash, errors.Wrapf(err, "failed to resolve tag %s", tag)
+		}
+	}
+
+	hash, err := resolveCommit(repo, local.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrapf(err, "failed to resolve tag %s", tag)
+	}
+	return hash, nil
+}
+
+// resolvePinned returns the commit for the target's pinned ref, which may be a
+// tag or a full commit SHA. The repository is only fetched if the ref can't be
+// found locally.
+func (s *refSession) resolvePinned(repo *git.Repository, r refRepository) (plumbing.Hash, error) {
+	hash, err := resolveRef(repo, r.target.Ref)
+	if err == nil {
+		return hash, nil
+	}
+	if err = s.fetch(repo, r); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hash, err = resolveRef(repo, r.target.Ref)
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrapf(err, "failed to resolve ref %s for %s", r.target.Ref, r.target.Name)
+	}
+	return hash, nil
+}
+
+func (s *refSession) fetch(repo *git.Repository, r refRepository) error {
+	err := repo.FetchContext(s.ctx, &git.FetchOptions{
+		Auth:  r.auth,
+		Tags:  git.AllTags,
+		Force: true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.Wrapf(err, "failed to fetch %s", r.target.Name)
+	}
+	return nil
+}
+
+// resolveRef returns the commit a tag name or commit SHA refers to.
+func resolveRef(repo *git.Repository, ref string) (plumbing.Hash, error) {
+	if tag, err := repo.Reference(plumbing.NewTagReferenceName(ref), false); err == nil {
+		return resolveCommit(repo, tag.Hash())
+	}
+	if !isHash(ref) {
+		return plumbing.ZeroHash, errors.Errorf("'%s' is neither a tag nor a full commit SHA", ref)
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(ref))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return commit.Hash, nil
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// resolveCommit returns the commit a hash points to, peeling annotated tags.
+func resolveCommit(repo *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	tag, err := repo.TagObject(hash)
+	if err == plumbing.ErrObjectNotFound {
+		return hash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	commit, err := tag.Commit()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return commit.Hash, nil
+}
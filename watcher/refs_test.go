@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/picostack/pico/task"
+)
+
+func TestRefSessionTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-tags")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	repo, err := git.PlainInit(upstream, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "test", Email: "test@pico.sh", When: time.Now()}
+
+	release := func(tag string, annotated bool) plumbing.Hash {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(upstream, "VERSION"), []byte(tag), 0644))
+		_, err := wt.Add("VERSION")
+		require.NoError(t, err)
+		h, err := wt.Commit(tag, &git.CommitOptions{Author: sig})
+		require.NoError(t, err)
+		var opts *git.CreateTagOptions
+		if annotated {
+			opts = &git.CreateTagOptions{Tagger: sig, Message: tag}
+		}
+		_, err = repo.CreateTag(tag, h, opts)
+		require.NoError(t, err)
+		return h
+	}
+
+	v1 := release("v1.0.0", false)
+	release("v2.0.0", false)
+
+	path := filepath.Join(dir, "target")
+	s := newRefSession(context.Background(), []refRepository{{
+		target: task.Target{Name: "target", RepoURL: upstream, Semver: "^1"},
+		path:   path,
+	}}, time.Second, 0)
+	defer s.Close()
+
+	require.NoError(t, s.Sync())
+	assert.Equal(t, v1.String(), headSHAAt(t, path))
+
+	changed, err := s.check(s.repos[0])
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	v11 := release("v1.1.0", true)
+
+	changed, err = s.check(s.repos[0])
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, v11.String(), headSHAAt(t, path))
+}
+
+func TestRefSessionPinned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	repo, err := git.PlainInit(upstream, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "test", Email: "test@pico.sh", When: time.Now()}
+
+	commit := func(message string) plumbing.Hash {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(upstream, "file"), []byte(message), 0644))
+		_, err := wt.Add("file")
+		require.NoError(t, err)
+		h, err := wt.Commit(message, &git.CommitOptions{Author: sig})
+		require.NoError(t, err)
+		return h
+	}
+
+	first := commit("first")
+	_, err = repo.CreateTag("stable", first, nil)
+	require.NoError(t, err)
+	second := commit("second")
+
+	path := filepath.Join(dir, "target")
+	pin := func(ref string) *refSession {
+		return newRefSession(context.Background(), []refRepository{{
+			target: task.Target{Name: "target", RepoURL: upstream, Ref: ref},
+			path:   path,
+		}}, time.Second, 0)
+	}
+
+	s := pin("stable")
+	require.NoError(t, s.Sync())
+	assert.Equal(t, first.String(), headSHAAt(t, path))
+	s.Close()
+
+	// new upstream commits are not followed
+	third := commit("third")
+	s = pin("stable")
+	changed, err := s.check(s.repos[0])
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	s.Close()
+
+	// changing the pinned ref checks out the new commit, fetching if necessary
+	s = pin(third.String())
+	require.NoError(t, s.Sync())
+	assert.Equal(t, third.String(), headSHAAt(t, path))
+	s.Close()
+
+	s = pin(second.String())
+	require.NoError(t, s.Sync())
+	assert.Equal(t, second.String(), headSHAAt(t, path))
+	s.Close()
+
+	s = pin("not-a-ref")
+	assert.Error(t, s.Sync())
+	s.Close()
+}
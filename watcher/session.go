@@ -0,0 +1,194 @@
+package watcher
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/metrics"
+	"github.com/picostack/pico/task"
+	"github.com/picostack/pico/watchdog"
+)
+
+// targetWatcher watches the repository of a single target. Targets that follow a
+// branch are watched by a BranchSession while targets that follow tags or are
+// pinned to a ref are watched by a refSession. Each target gets its own session
+// so it can be checked at its own interval.
+type targetWatcher struct {
+	target task.Target
+	key    watchKey
+	branch *BranchSession
+	refs   *refSession
+	cancel context.CancelFunc
+}
+
+// watchKey contains everything that determines how a target's repository is
+// watched. If any of it changes, the target's session must be restarted.
+type watchKey struct {
+	URL      string
+	Branch   string
+	Tag      string
+	Semver   string
+	Ref      string
+	Interval time.Duration
+	Auth     config.AuthMethod
+}
+
+func (w *GitWatcher) getWatchKey(t task.Target) watchKey {
+	key := watchKey{
+		URL:      t.RepoURL,
+		Branch:   t.Branch,
+		Tag:      t.Tag,
+		Semver:   t.Semver,
+		Ref:      t.Ref,
+		Interval: w.getInterval(t),
+	}
+	for _, a := range w.state.AuthMethods {
+		if a.Name == t.Auth {
+			key.Auth = a
+		}
+	}
+	return key
+}
+
+// Close stops the target's session
+func (tw *targetWatcher) Close() {
+	if tw.branch != nil {
+		tw.branch.Close()
+	}
+	if tw.refs != nil {
+		tw.refs.Close()
+	}
+	tw.cancel()
+}
+
+// watchTarget creates a watcher for the target and waits for its repository to
+// be cloned or updated before returning.
+func (w *GitWatcher) watchTarget(t task.Target) (*targetWatcher, error) {
+	dir := getTargetPath(t)
+	auth, err := w.getAuthForTarget(t)
+	if err != nil {
+		return nil, err
+	}
+	interval := w.getInterval(t)
+
+	zap.L().Debug("assigned target",
+		zap.String("url", t.RepoURL),
+		zap.String("directory", dir),
+		zap.Duration("interval", interval),
+		zap.Duration("jitter", w.checkJitter))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tw := &targetWatcher{target: t, key: w.getWatchKey(t), cancel: cancel}
+
+	if t.FollowsBranch() {
+		tw.branch, err = NewBranchSession(ctx, t.RepoURL, t.Branch, filepath.Join(w.directory, dir), auth, interval, w.checkJitter)
+		if err != nil {
+			cancel()
+			return nil, errors.Wrap(err, "failed to watch target")
+		}
+		if err = w.__waitpoint__watch_targets(tw.branch); err == nil {
+			go tw.branch.Run()
+			go w.forward(ctx, t.RepoURL, tw.branch.Events, tw.branch.Errors)
+		}
+	} else {
+		tw.refs = newRefSession(ctx, []refRepository{{
+			target: t,
+			path:   filepath.Join(w.directory, dir),
+			auth:   auth,
+		}}, interval, w.checkJitter)
+
+		if err = tw.refs.Sync(); err == nil {
+			go tw.refs.Run()
+			go w.forward(ctx, t.RepoURL, tw.refs.Events, tw.refs.Errors)
+		}
+	}
+	if err != nil {
+		tw.Close()
+		return nil, err
+	}
+
+	return tw, nil
+}
+
+func (w *GitWatcher) __waitpoint__watch_targets(s *BranchSession) error {
+	defer watchdog.Enter("watch_targets")()
+	return s.Sync()
+}
+
+// forward passes a session's events and errors to the daemon loop until the
+// session is closed.
+func (w *GitWatcher) forward(ctx context.Context, url string, events <-chan gitwatch.Event, errs <-chan error) {
+	for {
+		select {
+		case e := <-events:
+			select {
+			case w.events <- e:
+			case <-ctx.Done():
+				return
+			}
+		case e, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			metrics.GitErrors.WithLabelValues(url).Inc()
+			select {
+			case w.errors <- e:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// observeFetch records the duration of a fetch that started at the given time
+func observeFetch(url string, start time.Time) {
+	metrics.GitFetchDuration.WithLabelValues(url).Observe(time.Since(start).Seconds())
+}
+
+func (w *GitWatcher) getInterval(t task.Target) time.Duration {
+	if t.CheckInterval > 0 {
+		return time.Duration(t.CheckInterval)
+	}
+	return w.checkInterval
+}
+
+var (
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomMu sync.Mutex
+)
+
+// Jitter adds a random duration of up to max to the interval so that a fleet of
+// hosts that were configured at the same time don't poll in lockstep. Sessions
+// call it before every poll so the offset doesn't stay fixed.
+func Jitter(interval, max time.Duration) time.Duration {
+	if max <= 0 {
+		return interval
+	}
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return interval + time.Duration(random.Int63n(int64(max)))
+}
+
+// wait blocks for the duration, it returns false if the context is cancelled
+// first.
+func wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
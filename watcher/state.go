@@ -0,0 +1,274 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Southclaws/gitwatch"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/task"
+)
+
+// stateFile is where the last applied state is stored, within the directory the
+// watcher clones repositories into.
+const stateFile = ".pico-state.json"
+
+// persistedState is the targets that are deployed, along with the commit last
+// deployed successfully for each of them and any commit that failed its health
+// check, so the watcher can carry on where it left off when the daemon is
+// restarted. The environment and notification rules of the state aren't stored
+// since they may contain credentials, and neither is the env of each target,
+// only a hash of it to tell whether it changed.
+type persistedState struct {
+	State   config.State      `json:"state"`
+	Commits map[string]string `json:"commits"`
+	Failed  map[string]string `json:"failed,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// loadState reads the persisted state. If there is none, nil is returned.
+func loadState(directory string) (*persistedState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(directory, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read persisted state")
+	}
+	var s persistedState
+	if err = json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "failed to parse persisted state")
+	}
+	if s.Commits == nil {
+		s.Commits = make(map[string]string)
+	}
+	if s.Failed == nil {
+		s.Failed = make(map[string]string)
+	}
+	if s.Env == nil {
+		s.Env = make(map[string]string)
+	}
+	return &s, nil
+}
+
+// saveState writes the state to a temporary file and renames it into place so
+// a crash mid-write never leaves a corrupt state behind.
+func saveState(directory string, s persistedState) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+	if err = os.MkdirAll(directory, 0700); err != nil {
+		return errors.Wrap(err, "failed to create directory for state")
+	}
+	path := filepath.Join(directory, stateFile)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return errors.Wrap(err, "failed to write state")
+	}
+	return errors.Wrap(os.Rename(path+".tmp", path), "failed to replace state")
+}
+
+// persist stores the deployed targets and their commits, failures are only
+// logged since the watcher can carry on without them.
+func (w *GitWatcher) persist() {
+	w.saving.Lock()
+	defer w.saving.Unlock()
+
+	w.mu.Lock()
+	s := persistedState{
+		State: config.State{
+			Targets:     make(task.Targets, len(w.applied)),
+			AuthMethods: w.state.AuthMethods,
+			Shell:       w.state.Shell,
+		},
+		Commits: make(map[string]string),
+		Failed:  make(map[string]string),
+		Env:     make(map[string]string),
+	}
+	for i, t := range w.applied {
+		if len(t.Env) > 0 {
+			s.Env[t.Name] = hashEnv(t.Env)
+			t.Env = nil
+		}
+		s.State.Targets[i] = t
+	}
+	for k, v := range w.commits {
+		s.Commits[k] = v
+	}
+	for k, v := range w.failed {
+		s.Failed[k] = v
+	}
+	w.mu.Unlock()
+
+	if err := saveState(w.directory, s); err != nil {
+		zap.L().Warn("failed to persist state", zap.Error(err))
+	}
+}
+
+// restore loads the state that was applied before the daemon was last stopped
+// so the first state it's given is diffed against it. This means targets that
+// are unchanged aren't redeployed and targets removed while the daemon was
+// down still have their `down` commands run.
+func (w *GitWatcher) restore() {
+	s, err := loadState(w.directory)
+	if err != nil {
+		zap.L().Warn("ignoring persisted state", zap.Error(err))
+		return
+	}
+	if s == nil {
+		return
+	}
+	zap.L().Info("restored state from previous run",
+		zap.Int("targets", len(s.State.Targets)))
+
+	w.mu.Lock()
+	w.state = s.State
+	w.applied = s.State.Targets
+	w.commits = s.Commits
+	w.failed = s.Failed
+	w.restoredEnv = s.Env
+	w.mu.Unlock()
+}
+
+// restoreEnv gives the restored targets back the env they were deployed with, if
+// it's the same as the env they now have, so they're only seen as changed if it
+// differs. Restored targets that are shut down have to go without it.
+func (w *GitWatcher) restoreEnv(targets []task.Target) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.restoredEnv) == 0 {
+		return
+	}
+	env := make(map[string]map[string]string)
+	for _, t := range targets {
+		if hash, ok := w.restoredEnv[t.Name]; ok && hash == hashEnv(t.Env) {
+			env[t.Name] = t.Env
+		}
+	}
+	for _, restored := range [][]task.Target{w.state.Targets, w.applied} {
+		for i, t := range restored {
+			if e, ok := env[t.Name]; ok {
+				restored[i].Env = e
+			}
+		}
+	}
+	w.restoredEnv = nil
+}
+
+// hashEnv returns a hash of the environment that's the same for equal
+// environments, without revealing what they contain
+func hashEnv(env map[string]string) string {
+	b, _ := json.Marshal(env) //nolint:errcheck
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Finished records the outcome of a task once the executor has run it. A target
+// and its commit are only recorded as deployed once its `up` succeeds, and it's
+// only forgotten once its `down` has run after being removed or shut down, so a
+// restart in between picks up where it left off. A commit that fails its health
+// check is remembered so it isn't deployed again until the branch moves on.
+// Until then, running the target deploys the last healthy commit instead, which
+// is what's recorded.
+func (w *GitWatcher) Finished(t task.ExecutionTask, err error) {
+	var unhealthy *task.UnhealthyError
+	var redeployed *task.RedeployedError
+	if errors.As(err, &redeployed) && !t.Shutdown {
+		// the target runs with its new config, but still at the healthy commit
+		w.mu.Lock()
+		w.deployed(t.Target, redeployed.Previous)
+		w.failed[t.Target.Name] = redeployed.Commit
+		w.mu.Unlock()
+		w.persist()
+		return
+	}
+	if err != nil {
+		sha := t.Env["PICO_COMMIT_SHA"]
+		if t.Shutdown || sha == "" || !errors.As(err, &unhealthy) {
+			return
+		}
+		w.mu.Lock()
+		w.failed[t.Target.Name] = sha
+		w.mu.Unlock()
+		w.persist()
+		return
+	}
+	w.mu.Lock()
+	if !t.Shutdown {
+		w.deployed(t.Target, t.Env["PICO_COMMIT_SHA"])
+	} else if trigger := t.Env["PICO_TRIGGER"]; trigger == task.TriggerRemove || trigger == task.TriggerShutdown {
+		w.remove(t.Target.Name)
+	}
+	w.mu.Unlock()
+	w.persist()
+}
+
+// forget removes the target from the deployed targets without running it
+func (w *GitWatcher) forget(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.remove(name)
+}
+
+// deployed records the target as deployed at the commit, w.mu must be held
+func (w *GitWatcher) deployed(t task.Target, sha string) {
+	if sha != "" {
+		w.commits[t.Name] = sha
+		delete(w.failed, t.Name)
+	}
+	for i, a := range w.applied {
+		if a.Name == t.Name {
+			w.applied[i] = t
+			return
+		}
+	}
+	w.applied = append(w.applied, t)
+}
+
+// remove forgets a deployed target, w.mu must be held
+func (w *GitWatcher) remove(name string) {
+	delete(w.commits, name)
+	delete(w.failed, name)
+	for i, a := range w.applied {
+		if a.Name == name {
+			w.applied = append(w.applied[:i:i], w.applied[i+1:]...)
+			return
+		}
+	}
+}
+
+// catchUp handles targets whose repositories are at a different commit to the
+// one last deployed, either because they moved on while the daemon was down or
+// because the last attempt to deploy it failed.
+func (w *GitWatcher) catchUp() {
+	for _, t := range w.state.Targets {
+		w.mu.Lock()
+		sha, ok := w.commits[t.Name]
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+		path := filepath.Join(w.directory, getTargetPath(t))
+		info, err := getCommitInfo(path, "")
+		if err != nil || info.SHA == sha {
+			continue
+		}
+		zap.L().Info("target changed while stopped",
+			zap.String("target", t.Name),
+			zap.String("previous", sha),
+			zap.String("commit", info.SHA))
+		if err = w.handle(gitwatch.Event{URL: t.RepoURL, Path: path, Timestamp: time.Now()}); err != nil {
+			zap.L().Error("failed to handle event",
+				zap.String("url", t.RepoURL),
+				zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/picostack/pico/config"
+	"github.com/picostack/pico/task"
+)
+
+// runWatcher starts a watcher in the directory, applies the state and stops it again,
+// returning every task it dispatched. Each task is reported as successful.
+func runWatcher(t *testing.T, dir string, state config.State) (tasks []task.ExecutionTask) {
+	return runWatcherWith(t, dir, state, func(task.ExecutionTask) error { return nil })
+}
+
+// errCrashed is returned by a test executor for tasks that never finish because
+// the daemon stopped first, they aren't reported to the watcher.
+var errCrashed = errors.New("crashed")
+
+// runWatcherWith is runWatcher where the outcome of each task is decided by
+// execute.
+func runWatcherWith(t *testing.T, dir string, state config.State, execute func(task.ExecutionTask) error) (tasks []task.ExecutionTask) {
+	bus := make(chan task.ExecutionTask, 16)
+	gw := NewGitWatcher(dir, bus, time.Hour, 0, nil)
+	started := make(chan error, 1)
+	go func() { started <- gw.Start() }()
+
+	require.NoError(t, gw.SetState(state))
+	gw.Stop()
+	require.NoError(t, <-started)
+
+	for ex := range bus {
+		tasks = append(tasks, ex)
+		if err := execute(ex); err != errCrashed {
+			gw.Finished(ex, err)
+		}
+	}
+	return
+}
+
+func TestRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	keep := task.Target{Name: "keep", RepoURL: up.path, Up: []string{"true"}}
+	gone := task.Target{Name: "gone", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}}
+	added := task.Target{Name: "added", RepoURL: up.path, Up: []string{"true"}}
+
+	tasks := runWatcher(t, cache, config.State{Targets: []task.Target{keep, gone}})
+	assert.Len(t, tasks, 2)
+
+	// the watcher is restarted with gone removed from the config while it was
+	// down, so only gone is shut down and only added is deployed.
+	tasks = runWatcher(t, cache, config.State{Targets: []task.Target{keep, added}})
+	require.Len(t, tasks, 2)
+	assert.Equal(t, "gone", tasks[0].Target.Name)
+	assert.True(t, tasks[0].Shutdown)
+	assert.Equal(t, task.TriggerRemove, tasks[0].Env["PICO_TRIGGER"])
+	assert.Equal(t, "added", tasks[1].Target.Name)
+	assert.False(t, tasks[1].Shutdown)
+}
+
+func TestRestoreStateRemovedWithoutDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	keep := task.Target{Name: "keep", RepoURL: up.path, Up: []string{"true"}}
+	gone := task.Target{Name: "gone", RepoURL: up.path, Up: []string{"true"}}
+	require.Len(t, runWatcher(t, cache, config.State{Targets: []task.Target{keep, gone}}), 2)
+
+	// there's no `down` to run for the removed target, it's just forgotten
+	state := config.State{Targets: []task.Target{keep}}
+	assert.Empty(t, runWatcher(t, cache, state))
+	assert.Empty(t, runWatcher(t, cache, state))
+}
+
+func TestRestoreStateCatchUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	v1 := up.commit("one")
+	up.tag("v1.0.0", v1)
+	cache := filepath.Join(dir, "cache")
+
+	state := config.State{Targets: []task.Target{
+		{Name: "release", RepoURL: up.path, Semver: "^1", Up: []string{"true"}},
+	}}
+
+	tasks := runWatcher(t, cache, state)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v1, tasks[0].Env["PICO_COMMIT_SHA"])
+
+	// restarting with nothing new doesn't redeploy
+	assert.Empty(t, runWatcher(t, cache, state))
+
+	// a release made while the daemon was down is deployed on start
+	v2 := up.commit("two")
+	up.tag("v1.1.0", v2)
+
+	tasks = runWatcher(t, cache, state)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v2, tasks[0].Env["PICO_COMMIT_SHA"])
+	assert.Equal(t, v1, tasks[0].Env["PICO_PREVIOUS_SHA"])
+	assert.Equal(t, task.TriggerCommit, tasks[0].Env["PICO_TRIGGER"])
+}
+
+func TestInitialRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-initial")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	v1 := up.commit("one")
+	up.tag("v1.0.0", v1)
+	cache := filepath.Join(dir, "cache")
+
+	no := false
+	state := config.State{Targets: []task.Target{
+		{Name: "default", RepoURL: up.path, Semver: "^1", Up: []string{"true"}},
+		{Name: "later", RepoURL: up.path, Semver: "^1", Up: []string{"true"}, InitialRun: &no},
+	}}
+
+	// only the target that runs initially is deployed when first seen
+	tasks := runWatcher(t, cache, state)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, "default", tasks[0].Target.Name)
+
+	// restarting doesn't count as first sight, so neither runs
+	assert.Empty(t, runWatcher(t, cache, state))
+
+	// both run for the next release
+	v2 := up.commit("two")
+	up.tag("v1.1.0", v2)
+
+	tasks = runWatcher(t, cache, state)
+	require.Len(t, tasks, 2)
+	for _, ex := range tasks {
+		assert.Equal(t, v2, ex.Env["PICO_COMMIT_SHA"])
+		assert.Equal(t, v1, ex.Env["PICO_PREVIOUS_SHA"])
+	}
+}
+
+func TestRestoreStateUnfinished(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	v1 := up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	app := task.Target{Name: "app", RepoURL: up.path, Up: []string{"true"}, Down: []string{"true"}}
+	runWatcher(t, cache, config.State{Targets: []task.Target{app}})
+
+	// the daemon stops before the `down` of the removed target runs, so it's
+	// still shut down on the next start.
+	crash := func(task.ExecutionTask) error { return errCrashed }
+	tasks := runWatcherWith(t, cache, config.State{}, crash)
+	require.Len(t, tasks, 1)
+	assert.True(t, tasks[0].Shutdown)
+
+	tasks = runWatcher(t, cache, config.State{})
+	require.Len(t, tasks, 1)
+	assert.True(t, tasks[0].Shutdown)
+	assert.Equal(t, task.TriggerRemove, tasks[0].Env["PICO_TRIGGER"])
+
+	// once it has run the target is gone for good
+	assert.Empty(t, runWatcher(t, cache, config.State{}))
+
+	// a commit whose `up` fails isn't recorded as deployed, so it's retried on
+	// the next start.
+	state := config.State{Targets: []task.Target{app}}
+	runWatcher(t, cache, state)
+	v2 := up.commit("two")
+	fail := func(task.ExecutionTask) error { return errors.New("failed") }
+	tasks = runWatcherWith(t, cache, state, fail)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v2, tasks[0].Env["PICO_COMMIT_SHA"])
+
+	tasks = runWatcher(t, cache, state)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v2, tasks[0].Env["PICO_COMMIT_SHA"])
+	assert.Equal(t, v1, tasks[0].Env["PICO_PREVIOUS_SHA"])
+	assert.Equal(t, task.TriggerCommit, tasks[0].Env["PICO_TRIGGER"])
+
+	assert.Empty(t, runWatcher(t, cache, state))
+}
+
+func TestRestoreStateUnhealthy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	v1 := up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	state := config.State{Targets: []task.Target{{Name: "app", RepoURL: up.path, Up: []string{"true"}}}}
+	runWatcher(t, cache, state)
+
+	// a commit that fails its health check isn't tried again after a restart
+	v2 := up.commit("two")
+	unhealthy := func(task.ExecutionTask) error {
+		return task.HealthCheck{Command: []string{"false"}}.Check(".", "", nil, false, ioutil.Discard)
+	}
+	tasks := runWatcherWith(t, cache, state, unhealthy)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v2, tasks[0].Env["PICO_COMMIT_SHA"])
+
+	assert.Empty(t, runWatcher(t, cache, state))
+
+	// until the branch moves on
+	v3 := up.commit("three")
+	tasks = runWatcher(t, cache, state)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v3, tasks[0].Env["PICO_COMMIT_SHA"])
+	assert.Equal(t, v1, tasks[0].Env["PICO_PREVIOUS_SHA"])
+
+	assert.Empty(t, runWatcher(t, cache, state))
+}
+
+func TestRestoreStateRedeployed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	v1 := up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	state := config.State{Targets: []task.Target{{Name: "app", RepoURL: up.path, Up: []string{"true"}}}}
+	runWatcher(t, cache, state)
+
+	v2 := up.commit("two")
+	unhealthy := func(task.ExecutionTask) error {
+		return task.HealthCheck{Command: []string{"false"}}.Check(".", "", nil, false, ioutil.Discard)
+	}
+	require.Len(t, runWatcherWith(t, cache, state, unhealthy), 1)
+
+	// a config change while the branch is at the failed commit redeploys the
+	// healthy one, which is recorded along with the new config
+	changed := config.State{Targets: []task.Target{{Name: "app", RepoURL: up.path, Up: []string{"true"}, Env: map[string]string{"MODE": "new"}}}}
+	redeployed := func(ex task.ExecutionTask) error {
+		return &task.RedeployedError{Commit: ex.Env["PICO_COMMIT_SHA"], Previous: ex.Env["PICO_PREVIOUS_SHA"]}
+	}
+	tasks := runWatcherWith(t, cache, changed, redeployed)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, task.TriggerConfig, tasks[0].Env["PICO_TRIGGER"])
+	assert.Equal(t, v2, tasks[0].Env["PICO_COMMIT_SHA"])
+	assert.Equal(t, v1, tasks[0].Env["PICO_PREVIOUS_SHA"])
+
+	assert.Empty(t, runWatcher(t, cache, changed))
+
+	// the failed commit is still skipped, and the healthy one is still the one
+	// to roll back to
+	v3 := up.commit("three")
+	tasks = runWatcher(t, cache, changed)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, v3, tasks[0].Env["PICO_COMMIT_SHA"])
+	assert.Equal(t, v1, tasks[0].Env["PICO_PREVIOUS_SHA"])
+}
+
+func TestPersistedStateWithoutCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pico-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := newUpstream(t, filepath.Join(dir, "upstream"))
+	up.commit("one")
+	cache := filepath.Join(dir, "cache")
+
+	load := func(apiKey string) config.State {
+		configDir := filepath.Join(dir, "config")
+		require.NoError(t, os.MkdirAll(configDir, 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(configDir, "pico.js"), []byte(fmt.Sprintf(`
+		E("API_KEY", %q);
+		N({type: "slack", url: "https://hooks.slack.com/secret"});
+		T({name: "app", url: %q, up: ["true"]});
+		`, apiKey, up.path)), 0600))
+		state, err := config.ConfigFromDirectory(configDir, "host")
+		require.NoError(t, err)
+		return state
+	}
+
+	state := load("hunter2")
+	require.Equal(t, "hunter2", state.Targets[0].Env["API_KEY"])
+	require.Len(t, runWatcher(t, cache, state), 1)
+
+	b, err := ioutil.ReadFile(filepath.Join(cache, stateFile))
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"app"`)
+	assert.NotContains(t, string(b), "hunter2")
+	assert.NotContains(t, string(b), "API_KEY")
+	assert.NotContains(t, string(b), "hooks.slack.com")
+
+	// the target is still unchanged after a restart
+	assert.Empty(t, runWatcher(t, cache, load("hunter2")))
+
+	// but it's redeployed when its env changes
+	tasks := runWatcher(t, cache, load("correcthorse"))
+	require.Len(t, tasks, 1)
+	assert.Equal(t, task.TriggerConfig, tasks[0].Env["PICO_TRIGGER"])
+	assert.Equal(t, "correcthorse", tasks[0].Target.Env["API_KEY"])
+}
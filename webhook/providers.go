@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec - GitHub's legacy signature header uses SHA1
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// provider describes how a forge identifies, signs and labels its webhooks.
+type provider struct {
+	name        string
+	eventHeader string
+	pushEvents  []string
+	verify      func(h http.Header, body []byte, secret string) error
+}
+
+// Gitea also sends GitHub's headers for compatibility, so it's checked first.
+var providers = []provider{
+	{"gitea", "X-Gitea-Event", []string{"push"}, verifyGitea},
+	{"github", "X-GitHub-Event", []string{"push"}, verifyGitHub},
+	{"gitlab", "X-Gitlab-Event", []string{"Push Hook", "Tag Push Hook"}, verifyGitLab},
+	{"bitbucket", "X-Event-Key", []string{"repo:push", "repo:refs_changed"}, verifyGitHub},
+}
+
+func detect(h http.Header) (*provider, string) {
+	for i, p := range providers {
+		if event := h.Get(p.eventHeader); event != "" {
+			return &providers[i], event
+		}
+	}
+	return nil, ""
+}
+
+func (p *provider) isPush(event string) bool {
+	for _, e := range p.pushEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyGitHub checks the `sha256=` or legacy `sha1=` HMAC signature headers
+// used by GitHub and Bitbucket.
+func verifyGitHub(h http.Header, body []byte, secret string) error {
+	if sig := h.Get("X-Hub-Signature-256"); sig != "" {
+		return checkHMAC(sha256.New, strings.TrimPrefix(sig, "sha256="), body, secret)
+	}
+	sig := h.Get("X-Hub-Signature")
+	switch {
+	case strings.HasPrefix(sig, "sha256="):
+		return checkHMAC(sha256.New, strings.TrimPrefix(sig, "sha256="), body, secret)
+	case strings.HasPrefix(sig, "sha1="):
+		return checkHMAC(sha1.New, strings.TrimPrefix(sig, "sha1="), body, secret)
+	}
+	return errors.New("missing signature header")
+}
+
+func verifyGitea(h http.Header, body []byte, secret string) error {
+	sig := h.Get("X-Gitea-Signature")
+	if sig == "" {
+		return errors.New("missing signature header")
+	}
+	return checkHMAC(sha256.New, sig, body, secret)
+}
+
+// verifyGitLab compares the token header since GitLab doesn't sign payloads.
+func verifyGitLab(h http.Header, body []byte, secret string) error {
+	if subtle.ConstantTimeCompare([]byte(h.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+		return errors.New("token mismatch")
+	}
+	return nil
+}
+
+func checkHMAC(fn func() hash.Hash, signature string, body []byte, secret string) error {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "malformed signature")
+	}
+	mac := hmac.New(fn, []byte(secret))
+	mac.Write(body) //nolint:errcheck
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// payload contains the fields of each forge's push payload that identify the
+// repository that was pushed to.
+type payload struct {
+	Repository struct {
+		CloneURL   string `json:"clone_url"`
+		SSHURL     string `json:"ssh_url"`
+		HTMLURL    string `json:"html_url"`
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		Links      struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+			Clone []struct {
+				Href string `json:"href"`
+			} `json:"clone"`
+		} `json:"links"`
+	} `json:"repository"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+func repoURLs(body []byte) ([]string, error) {
+	var p payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+
+	candidates := []string{
+		p.Repository.CloneURL,
+		p.Repository.SSHURL,
+		p.Repository.HTMLURL,
+		p.Repository.GitHTTPURL,
+		p.Repository.GitSSHURL,
+		p.Repository.Links.HTML.Href,
+		p.Project.GitHTTPURL,
+		p.Project.GitSSHURL,
+		p.Project.WebURL,
+	}
+	for _, c := range p.Repository.Links.Clone {
+		candidates = append(candidates, c.Href)
+	}
+
+	urls := []string{}
+	for _, c := range candidates {
+		if c != "" {
+			urls = append(urls, c)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("payload does not contain a repository URL")
+	}
+	return urls, nil
+}
+
+var (
+	scheme   = regexp.MustCompile(`^[a-z+]+://`)
+	userinfo = regexp.MustCompile(`^[^/@]+@`)
+	port     = regexp.MustCompile(`^([^/:]+):\d+/`)
+	scpStyle = regexp.MustCompile(`^([^/:]+):`)
+)
+
+// SameRepository reports whether two Git URLs refer to the same repository,
+// ignoring the protocol, credentials, port and `.git` suffix so an SSH clone
+// URL matches the HTTPS URL sent in a webhook payload.
+func SameRepository(a, b string) bool {
+	return normalise(a) == normalise(b)
+}
+
+func normalise(url string) string {
+	url = strings.ToLower(strings.TrimSpace(url))
+	url = scheme.ReplaceAllString(url, "")
+	url = userinfo.ReplaceAllString(url, "")
+	url = port.ReplaceAllString(url, "$1/")
+	url = scpStyle.ReplaceAllString(url, "$1/")
+	url = strings.TrimSuffix(url, "/")
+	url = strings.TrimSuffix(url, ".git")
+	return url
+}
@@ -0,0 +1,111 @@
+// Package webhook provides an HTTP listener for push webhooks from Git forges.
+// When a push to a repository arrives, every registered Syncer is asked to sync
+// any repositories it manages that match so changes are applied immediately
+// instead of at the next check interval.
+package webhook
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// maxBodySize is the largest webhook payload that will be read, forges cap
+// their payloads well below this.
+const maxBodySize = 25 << 20
+
+// Syncer describes a type that manages Git repositories and can be asked to
+// fetch them immediately. The match function reports whether a repository URL
+// refers to the repository that was pushed to.
+type Syncer interface {
+	Sync(match func(url string) bool)
+}
+
+// Server handles push webhooks from GitHub, GitLab, Gitea and Bitbucket.
+type Server struct {
+	secret  string
+	syncers []Syncer
+}
+
+// New creates a webhook server that notifies the given syncers. If secret is
+// set, every request must be signed with it.
+func New(secret string, syncers ...Syncer) *Server {
+	return &Server{
+		secret:  secret,
+		syncers: syncers,
+	}
+}
+
+// ListenAndServe starts the HTTP listener and blocks until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	if s.secret == "" {
+		zap.L().Warn("webhook listener has no secret, requests will not be verified")
+	}
+	zap.L().Info("webhook listener started", zap.String("address", addr))
+	return http.ListenAndServe(addr, s)
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	p, event := detect(r.Header)
+	if p == nil {
+		http.Error(w, "unrecognised webhook", http.StatusBadRequest)
+		return
+	}
+
+	if s.secret != "" {
+		if err = p.verify(r.Header, body, s.secret); err != nil {
+			zap.L().Warn("rejected webhook",
+				zap.String("provider", p.name),
+				zap.String("remote", r.RemoteAddr),
+				zap.Error(err))
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if !p.isPush(event) {
+		zap.L().Debug("ignoring webhook event",
+			zap.String("provider", p.name),
+			zap.String("event", event))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	urls, err := repoURLs(body)
+	if err != nil {
+		http.Error(w, "failed to parse payload", http.StatusBadRequest)
+		return
+	}
+
+	zap.L().Debug("received push webhook",
+		zap.String("provider", p.name),
+		zap.Strings("urls", urls))
+
+	match := func(url string) bool {
+		for _, u := range urls {
+			if SameRepository(u, url) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, syncer := range s.syncers {
+		syncer.Sync(match)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}